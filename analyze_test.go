@@ -9,7 +9,14 @@ package main
 
 import (
 	"fmt"
+	gcfg "gopkg.in/gcfg.v1"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
 	"time"
 )
@@ -292,555 +299,3239 @@ var testtab9 = testTable{
 	},
 }
 
+// Tests configured source address exclusions
+var testtab10 = testTable{
+	{
+		phaseType: FUNC,
+		chkFunc:   testtab10FuncPre,
+	},
+	{
+		phaseType: EVENT,
+		events: []testEvent{
+			{"user@host.com", "63.245.214.133", "", 5},
+			{"user@host.com", "118.163.10.187", "", 1},
+		},
+	},
+	{
+		phaseType: FUNC,
+		chkFunc:   testtab10Func,
+	},
+	{
+		phaseType: FUNC,
+		chkFunc:   testtab10FuncClear,
+	},
+	{
+		phaseType: EVENT,
+		events: []testEvent{
+			{"user@host.com", "63.245.214.133", "", 1},
+		},
+	},
+	{
+		phaseType: FUNC,
+		chkFunc:   testtab10FuncPost,
+	},
+	{
+		phaseType: FUNC,
+		chkFunc:   testtab10FuncMove,
+	},
+	{
+		phaseType: EVENT,
+		events: []testEvent{
+			{"user@host.com", "118.163.10.187", "", 1},
+		},
+	},
+	{
+		phaseType: FUNC,
+		chkFunc:   testtab10FuncMovePost,
+	},
+}
+
+// Tests overrides claiming internal address ranges
+var testtab11 = testTable{
+	{
+		phaseType: FUNC,
+		chkFunc:   testtab11FuncPre,
+	},
+	{
+		phaseType: EVENT,
+		events: []testEvent{
+			{"user@host.com", "10.1.2.3", "", 3},
+			{"user@host.com", "10.2.0.1", "", 1},
+		},
+	},
+	{
+		phaseType: FUNC,
+		chkFunc:   testtab11Func,
+	},
+}
+
+// Tests severity adjustment for tor exit nodes
+var testtab12 = testTable{
+	{
+		phaseType: FUNC,
+		chkFunc:   testtab12FuncPre,
+	},
+	{
+		phaseType: EVENT,
+		events: []testEvent{
+			{"user@host.com", "63.245.214.133", "", 15},
+		},
+	},
+	{
+		phaseType: EVENT,
+		events: []testEvent{
+			{"user@host.com", "118.163.10.187", "", 1},
+		},
+	},
+	{
+		phaseType: FUNC,
+		chkFunc:   testtab12Func,
+	},
+}
+
+// Tests re-geolocation of stored results if the MaxMind database changes
+var testtab13 = testTable{
+	{
+		phaseType: EVENT,
+		events: []testEvent{
+			{"user@host.com", "63.245.214.133", "1h", 10},
+		},
+	},
+	{
+		phaseType: FUNC,
+		chkFunc:   testtab13FuncPre,
+	},
+	{
+		phaseType: EVENT,
+		events: []testEvent{
+			{"user@host.com", "63.245.214.133", "", 1},
+		},
+	},
+	{
+		phaseType: FUNC,
+		chkFunc:   testtab13Func,
+	},
+}
+
+// Tests use of the accuracy radius in collapse and movement decisions
+var testtab14 = testTable{
+	{
+		phaseType: FUNC,
+		chkFunc:   testtab14Func,
+	},
+}
+
+// Tests parsing and matching of the overrides file
+var testtab15 = testTable{
+	{
+		phaseType: FUNC,
+		chkFunc:   testtab15Func,
+	},
+}
+
+// Tests locality details and display language
+var testtab16 = testTable{
+	{
+		phaseType: FUNC,
+		chkFunc:   testtab16FuncPre,
+	},
+	{
+		phaseType: EVENT,
+		events: []testEvent{
+			{"user@host.com", "63.245.214.133", "", 1},
+		},
+	},
+	{
+		phaseType: FUNC,
+		chkFunc:   testtab16Func,
+	},
+}
+
+// Tests keeping results where the country is unknown
+var testtab17 = testTable{
+	{
+		phaseType: FUNC,
+		chkFunc:   testtab17FuncPre,
+	},
+	{
+		phaseType: EVENT,
+		events: []testEvent{
+			{"user@host.com", "63.245.214.133", "72h", 2},
+		},
+	},
+	{
+		phaseType: EVENT,
+		events: []testEvent{
+			{"user@host.com", "255.255.255.255", "", 1},
+		},
+	},
+	{
+		phaseType: FUNC,
+		chkFunc:   testtab17Func,
+	},
+}
+
+// Tests velocity based movement analysis
+var testtab18 = testTable{
+	{
+		phaseType: FUNC,
+		chkFunc:   testtab18FuncPre,
+	},
+	{
+		phaseType: EVENT,
+		events: []testEvent{
+			{"user@host.com", "63.245.214.133", "3h50m", 5},
+		},
+	},
+	{
+		phaseType: EVENT,
+		events: []testEvent{
+			{"user@host.com", "207.126.102.129", "1h50m", 1},
+		},
+	},
+	{
+		phaseType: FUNC,
+		chkFunc:   testtab18FuncPlausible,
+	},
+	{
+		phaseType: EVENT,
+		events: []testEvent{
+			{"user@host.com", "63.245.214.133", "1h45m", 1},
+		},
+	},
+	{
+		phaseType: FUNC,
+		chkFunc:   testtab18FuncImpossible,
+	},
+}
+
+// Tests movement analysis relative to event time
+var testtab19 = testTable{
+	{
+		phaseType: EVENT,
+		events: []testEvent{
+			{"user@host.com", "63.245.214.133", "48h", 5},
+			{"user@host.com", "118.163.10.187", "47h", 1},
+			{"user@host.com", "63.245.214.133", "", 5},
+		},
+	},
+	{
+		phaseType: FUNC,
+		chkFunc:   testtab19Func,
+	},
+}
+
+// Tests the learning period for new principals
+var testtab20 = testTable{
+	{
+		phaseType: FUNC,
+		chkFunc:   testtab20FuncPre,
+	},
+	{
+		phaseType: EVENT,
+		events: []testEvent{
+			{"user@host.com", "63.245.214.133", "48h", 5},
+		},
+	},
+	{
+		phaseType: FUNC,
+		chkFunc:   testtab20FuncLearning,
+	},
+	{
+		phaseType: EVENT,
+		events: []testEvent{
+			{"user@host.com", "63.245.214.133", "", 5},
+		},
+	},
+	{
+		phaseType: FUNC,
+		chkFunc:   testtab20FuncLearned,
+	},
+}
+
+// Tests seeding of principal home locations
+var testtab21 = testTable{
+	{
+		phaseType: FUNC,
+		chkFunc:   testtab21FuncPre,
+	},
+	{
+		phaseType: EVENT,
+		events: []testEvent{
+			{"user@host.com", "118.163.10.187", "", 1},
+		},
+	},
+	{
+		phaseType: EVENT,
+		events: []testEvent{
+			{"user@host.com", "63.245.214.133", "", 1},
+		},
+	},
+	{
+		phaseType: FUNC,
+		chkFunc:   testtab21Func,
+	},
+	{
+		phaseType: FUNC,
+		chkFunc:   testtab21FuncEpoch,
+	},
+	{
+		phaseType: EVENT,
+		events: []testEvent{
+			{"user@host.com", "63.245.214.133", "", 1},
+		},
+	},
+	{
+		phaseType: FUNC,
+		chkFunc:   testtab21FuncRegeo,
+	},
+}
+
+// Tests the long-term history summary
+var testtab22 = testTable{
+	{
+		phaseType: FUNC,
+		chkFunc:   testtab22FuncPre,
+	},
+	{
+		phaseType: EVENT,
+		events: []testEvent{
+			{"user@host.com", "118.163.10.187", "1000h", 3},
+		},
+	},
+	{
+		phaseType: EVENT,
+		events: []testEvent{
+			{"user@host.com", "63.245.214.133", "2h", 1},
+		},
+	},
+	{
+		phaseType: EVENT,
+		events: []testEvent{
+			{"user@host.com", "118.163.10.187", "", 1},
+		},
+	},
+	{
+		phaseType: FUNC,
+		chkFunc:   testtab22Func,
+	},
+}
+
+// Tests severity based on the country history of the principal
+var testtab23 = testTable{
+	{
+		phaseType: EVENT,
+		events: []testEvent{
+			{"user@host.com", "207.126.102.7", "10h", 1},
+		},
+	},
+	{
+		phaseType: EVENT,
+		events: []testEvent{
+			{"user@host.com", "118.163.10.187", "6h", 1},
+		},
+	},
+	{
+		phaseType: EVENT,
+		events: []testEvent{
+			{"user@host.com", "63.245.214.133", "", 1},
+		},
+	},
+	{
+		phaseType: FUNC,
+		chkFunc:   testtab23Func,
+	},
+}
+
+// Tests the country policy
+var testtab24 = testTable{
+	{
+		phaseType: FUNC,
+		chkFunc:   testtab24FuncPre,
+	},
+	{
+		phaseType: EVENT,
+		events: []testEvent{
+			{"user@host.com", "63.245.214.133", "1h", 5},
+			{"user@host.com", "118.163.10.187", "", 1},
+		},
+	},
+	{
+		phaseType: FUNC,
+		chkFunc:   testtab24Func,
+	},
+}
+
+// Tests principal group policies
+var testtab25 = testTable{
+	{
+		phaseType: FUNC,
+		chkFunc:   testtab25FuncPre,
+	},
+	{
+		phaseType: EVENT,
+		events: []testEvent{
+			{"user@finance.host.com", "63.245.214.133", "1h", 5},
+			{"user@finance.host.com", "118.163.10.187", "", 1},
+			{"user@host.com", "63.245.214.133", "1h", 5},
+			{"user@host.com", "118.163.10.187", "", 1},
+		},
+	},
+	{
+		phaseType: FUNC,
+		chkFunc:   testtab25Func,
+	},
+}
+
+// Tests clustering of results into localities
+var testtab26 = testTable{
+	{
+		phaseType: FUNC,
+		chkFunc:   testtab26Func,
+	},
+}
+
+// Tests compaction of results
+var testtab27 = testTable{
+	{
+		phaseType: FUNC,
+		chkFunc:   testtab27FuncPre,
+	},
+	{
+		phaseType: EVENT,
+		events: []testEvent{
+			{"user@host.com", "63.245.214.133", "48h", 10},
+		},
+	},
+	{
+		phaseType: EVENT,
+		events: []testEvent{
+			{"user@host.com", "63.245.214.133", "", 2},
+		},
+	},
+	{
+		phaseType: FUNC,
+		chkFunc:   testtab27Func,
+	},
+}
+
+// Tests primary geocenters
+var testtab28 = testTable{
+	{
+		phaseType: EVENT,
+		events: []testEvent{
+			{"user@host.com", "63.245.214.133", "10h", 6},
+			{"user@host.com", "118.163.10.187", "5h", 3},
+			{"user@host.com", "207.126.102.7", "", 1},
+		},
+	},
+	{
+		phaseType: FUNC,
+		chkFunc:   testtab28Func,
+	},
+}
+
+// Tests the login time profile
+var testtab29 = testTable{
+	{
+		phaseType: EVENT,
+		events: []testEvent{
+			{"user@host.com", "63.245.214.133", "", 5},
+		},
+	},
+	{
+		phaseType: FUNC,
+		chkFunc:   testtab29Func,
+	},
+}
+
+// Tests shared source address detection
+var testtab30 = testTable{
+	{
+		phaseType: FUNC,
+		chkFunc:   testtab30FuncPre,
+	},
+	{
+		phaseType: EVENT,
+		events: []testEvent{
+			{"user1@host.com", "63.245.214.133", "", 1},
+			{"user2@host.com", "63.245.214.133", "", 1},
+			{"user3@host.com", "63.245.214.133", "", 1},
+			{"user1@host.com", "207.126.102.7", "", 1},
+			{"user2@host.com", "207.126.102.7", "", 1},
+			{"user3@host.com", "207.126.102.7", "", 1},
+			{"user1@host.com", "118.163.10.187", "", 1},
+			{"user2@host.com", "118.163.10.187", "", 1},
+		},
+	},
+	{
+		phaseType: FUNC,
+		chkFunc:   testtab30Func,
+	},
+}
+
+// Tests location shift detection
+var testtab31 = testTable{
+	{
+		phaseType: FUNC,
+		chkFunc:   testtab31FuncPre,
+	},
+	{
+		phaseType: EVENT,
+		events: []testEvent{
+			{"user1@host.com", "63.245.214.133", "", 1},
+			{"user2@host.com", "63.245.214.133", "", 1},
+			{"user3@host.com", "63.245.214.133", "", 1},
+			{"user4@host.com", "118.163.10.187", "", 1},
+		},
+	},
+	{
+		phaseType: FUNC,
+		chkFunc:   testtab31Func,
+	},
+}
+
+// Tests travel notices
+var testtab32 = testTable{
+	{
+		phaseType: FUNC,
+		chkFunc:   testtab32FuncPre,
+	},
+	{
+		phaseType: EVENT,
+		events: []testEvent{
+			{"user@host.com", "63.245.214.133", "2h", 1},
+			{"user@host.com", "118.163.10.187", "", 1},
+		},
+	},
+	{
+		phaseType: FUNC,
+		chkFunc:   testtab32Func,
+	},
+}
+
+// Tests analyst feedback
+var testtab33 = testTable{
+	{
+		phaseType: EVENT,
+		events: []testEvent{
+			{"user@host.com", "63.245.214.133", "10h", 1},
+			{"user@host.com", "118.163.10.187", "9h", 1},
+		},
+	},
+	{
+		phaseType: FUNC,
+		chkFunc:   testtab33FuncFeedback,
+	},
+	{
+		phaseType: EVENT,
+		events: []testEvent{
+			{"user@host.com", "63.245.214.133", "", 1},
+		},
+	},
+	{
+		phaseType: FUNC,
+		chkFunc:   testtab33Func,
+	},
+	{
+		phaseType: FUNC,
+		chkFunc:   testtab33FuncStandalone,
+	},
+	{
+		phaseType: EVENT,
+		events: []testEvent{
+			{"other@host.com", "63.245.214.133", "", 1},
+		},
+	},
+	{
+		phaseType: FUNC,
+		chkFunc:   testtab33FuncStandaloneCheck,
+	},
+}
+
+// Tests authentication of API requests
+var testtab34 = testTable{
+	{
+		phaseType: FUNC,
+		chkFunc:   testtab34Func,
+	},
+}
+
+// Tests identification of new networks within known localities, using the
+// ASN database specified by TESTASNMMF
+var testtab35 = testTable{
+	{
+		phaseType: FUNC,
+		chkFunc:   testtab35FuncPre,
+	},
+	{
+		phaseType: EVENT,
+		events: []testEvent{
+			{"user@host.com", "63.245.214.133", "1h", 5},
+		},
+	},
+	{
+		phaseType: FUNC,
+		chkFunc:   testtab35Func,
+	},
+}
+
+// Tests that results from noalert ranges are kept out of the history summary
+// and login time profile
+var testtab36 = testTable{
+	{
+		phaseType: FUNC,
+		chkFunc:   testtab36FuncPre,
+	},
+	{
+		phaseType: EVENT,
+		events: []testEvent{
+			{"user@host.com", "118.163.10.187", "1000h", 3},
+		},
+	},
+	{
+		phaseType: FUNC,
+		chkFunc:   testtab10FuncClear,
+	},
+	{
+		phaseType: EVENT,
+		events: []testEvent{
+			{"user@host.com", "63.245.214.133", "2h", 1},
+		},
+	},
+	{
+		phaseType: EVENT,
+		events: []testEvent{
+			{"user@host.com", "118.163.10.187", "", 1},
+		},
+	},
+	{
+		phaseType: FUNC,
+		chkFunc:   testtab36Func,
+	},
+}
+
 type simpleStateService struct {
 	store map[string]object
 }
 
-func (s *simpleStateService) readObject(objid string) (o *object, err error) {
-	r, ok := s.store[objid]
-	if !ok {
-		return nil, nil
+func (s *simpleStateService) readObject(objid string) (o *object, err error) {
+	r, ok := s.store[objid]
+	if !ok {
+		return nil, nil
+	}
+	return &r, nil
+}
+
+func (s *simpleStateService) writeObject(o object) (err error) {
+	s.store[o.ObjectID] = o
+	return nil
+}
+
+func (s *simpleStateService) doInit() (err error) {
+	s.store = make(map[string]object)
+	return nil
+}
+
+func (s *simpleStateService) getStore() map[string]object {
+	return s.store
+}
+
+func makePhaseResults(tp []testEvent) (pluginResult, error) {
+	var ret pluginResult
+
+	ret.Results = make([]eventResult, 0)
+	for i := range tp {
+		for j := 1; j <= tp[i].n; j++ {
+			newres := eventResult{}
+			newres.Timestamp = time.Now().UTC()
+			if tp[i].durationSub != "" {
+				dur, err := time.ParseDuration(tp[i].durationSub)
+				if err != nil {
+					return ret, err
+				}
+				newres.Timestamp = newres.Timestamp.Add(-1 * dur)
+			}
+			newres.Principal = tp[i].p
+			newres.SourceIPV4 = tp[i].srcip
+			newres.Name = "test"
+			newres.Valid = true
+			err := newres.validate()
+			if err != nil {
+				return ret, err
+			}
+			ret.Results = append(ret.Results, newres)
+		}
+	}
+
+	return ret, nil
+}
+
+func runTestPhase(tp testPhase) error {
+	switch tp.phaseType {
+	case EVENT:
+		ev, err := makePhaseResults(tp.events)
+		if err != nil {
+			return err
+		}
+		integrate(ev)
+		err = integrationMergeQueue()
+		if err != nil {
+			return err
+		}
+	case FUNC:
+		err := tp.chkFunc()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runTestTable(testtab testTable, t *testing.T) {
+	defer func() {
+		if e := recover(); e != nil {
+			t.Fatalf("test failed: %v", e)
+		}
+	}()
+
+	err := testGenericInit()
+	if err != nil {
+		panic(err)
+	}
+	for i := range testtab {
+		err := runTestPhase(testtab[i])
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+
+func testGenericInit() error {
+	cfg.General.MaxMind = os.Getenv("TESTMMF")
+	cfg.General.MaxMindASN = ""
+	cfg.Geo.CollapseMaximum = 500
+	cfg.Geo.MovementDistance = 2000
+	cfg.Geo.MovementWindow = "4h"
+	cfg.Geo.Regeolocate = false
+	cfg.Geo.UnknownCountry = ""
+	cfg.Geo.MaxSpeed = 0
+	cfg.Geo.MinTravelDistance = 0
+	cfg.Geo.LearningPeriod = ""
+	cfg.Geo.LearningEvents = 0
+	cfg.Geo.LearningMode = ""
+	cfg.Timer.ExpireEvents = "720h"
+	cfg.noSendAlert = true
+	cfg.exclusions = nil
+	cfg.overrides = nil
+	cfg.torExitNodes = nil
+	cfg.General.Language = ""
+	cfg.homeLocations = nil
+	cfg.Geo.HistoryRetention = ""
+	cfg.Geo.CountryRecency = ""
+	cfg.Geo.GeocenterDistance = 0
+	cfg.countryPolicies = nil
+	cfg.groups = nil
+	cfg.Geo.CompactEvents = false
+	cfg.Geo.PrimaryGeocenters = 0
+	cfg.Geo.UnusualTime = false
+	cfg.Geo.SharedIPThreshold = 0
+	cfg.Geo.SharedIPWindow = ""
+	cfg.sharedEgress = nil
+	sharedIPs.reset()
+	cfg.Geo.StormThreshold = 0
+	cfg.Geo.StormWindow = ""
+	cfg.Geo.StormGrace = ""
+	storms.reset()
+	cfg.Geo.TravelMode = ""
+	travelNotices.reset()
+	cfg.apiTokens = nil
+	err := maxmindInit()
+	if err != nil {
+		return err
+	}
+	setStateService(&simpleStateService{})
+	getStateService().(*simpleStateService).doInit()
+	return nil
+}
+
+func testtab0Func() error {
+	s := getStateService().(*simpleStateService).getStore()
+	cnt := len(s)
+	if cnt != 1 {
+		return fmt.Errorf("more than one entry in state")
+	}
+	for _, v := range s {
+		if len(v.Results) != 1 {
+			panic("more than one result in state entry")
+		}
+		if v.Results[0].SourceIPV4 != "63.245.214.133" {
+			panic("result we had was not the correct one")
+		}
+	}
+	return nil
+}
+
+func testtab1Func() error {
+	s := getStateService().(*simpleStateService).getStore()
+	for _, v := range s {
+		if v.WeightDeviation != 0 {
+			return fmt.Errorf("weight deviation was not 0")
+		}
+		if v.NumCenters != 1 {
+			return fmt.Errorf("incorrect number of geocenters")
+		}
+	}
+	return nil
+}
+
+func testtab2Func() error {
+	s := getStateService().(*simpleStateService).getStore()
+	if len(s) != 1 {
+		return fmt.Errorf("more than one entry in state")
+	}
+	for _, v := range s {
+		if v.WeightDeviation == 0 {
+			return fmt.Errorf("weight threshold was 0")
+		}
+		if v.NumCenters != 2 {
+			return fmt.Errorf("incorrect number of geocenters")
+		}
+		collapseCnt := 0
+		for _, x := range v.Results {
+			if x.Collapsed {
+				collapseCnt++
+			}
+		}
+		if collapseCnt != 19 {
+			return fmt.Errorf("incorrect number of collapsed results")
+		}
+		for _, x := range v.Results {
+			if !x.Escalated {
+				return fmt.Errorf("a result entry was not escalated")
+			}
+		}
+	}
+	return nil
+}
+
+func testtab3Func() error {
+	s := getStateService().(*simpleStateService).getStore()
+	if len(s) != 1 {
+		return fmt.Errorf("more than one entry in state")
+	}
+	for _, v := range s {
+		if v.WeightDeviation != 0 {
+			return fmt.Errorf("weight threshold was not 0")
+		}
+		if v.NumCenters != 2 {
+			return fmt.Errorf("incorrect number of geocenters")
+		}
+		collapseCnt := 0
+		for _, x := range v.Results {
+			if x.Collapsed {
+				collapseCnt++
+			}
+		}
+		if collapseCnt != 28 {
+			return fmt.Errorf("incorrect number of collapsed results")
+		}
+		for _, x := range v.Results {
+			if !x.Escalated {
+				return fmt.Errorf("a result entry was not escalated")
+			}
+		}
+	}
+	return nil
+}
+
+func testtab4FuncPre() error {
+	s := getStateService().(*simpleStateService).getStore()
+	if len(s) != 1 {
+		return fmt.Errorf("more than one entry in state")
+	}
+	for _, v := range s {
+		if v.WeightDeviation != 0 {
+			return fmt.Errorf("weight threshold was not 0")
+		}
+		if v.NumCenters != 1 {
+			return fmt.Errorf("incorrect number of geocenters")
+		}
+		collapseCnt := 0
+		for _, x := range v.Results {
+			if x.Collapsed {
+				collapseCnt++
+			}
+		}
+		if collapseCnt != 14 {
+			return fmt.Errorf("incorrect number of collapsed results")
+		}
+		for _, x := range v.Results {
+			if !x.Escalated {
+				return fmt.Errorf("a result entry was not escalated")
+			}
+		}
+		// Locate the branch entry last created and validate alert
+		// generation
+		testStr := "user@host.com NEWLOCATION Mountain View, United States "
+		testStr += "access from 63.245.214.133 (test) [deviation:0],"
+		testStr += " no previous locations stored in window"
+		var o objectResult
+		for _, x := range v.Results {
+			if x.Collapsed {
+				continue
+			}
+			if x.SourceIPV4 != "63.245.214.133" {
+				continue
+			}
+			o = x
+			break
+		}
+		ad, err := v.createAlertDetailsBranch(o.BranchID)
+		if err != nil {
+			return err
+		}
+		err = ad.addPreviousEvent(&v, o.BranchID)
+		if err != nil {
+			return err
+		}
+		err = ad.calculateSeverity()
+		if err != nil {
+			return err
+		}
+		// This is a new alert with no previous country details, so we should have
+		// a severity of 1
+		if ad.Severity != 1 {
+			return fmt.Errorf("alert had incorrect severity")
+		}
+		if ad.Category != "NEWLOCATION" {
+			return fmt.Errorf("alert had incorrect category")
+		}
+		sumstr, err := ad.makeSummary()
+		if err != nil {
+			return err
+		}
+		if sumstr != testStr {
+			return fmt.Errorf("alert summary did not match")
+		}
+	}
+	return nil
+}
+
+func testtab4FuncPost() error {
+	s := getStateService().(*simpleStateService).getStore()
+	if len(s) != 1 {
+		return fmt.Errorf("more than one entry in state")
+	}
+	for _, v := range s {
+		if v.WeightDeviation == 0 {
+			return fmt.Errorf("weight threshold was 0")
+		}
+		if v.NumCenters != 2 {
+			return fmt.Errorf("incorrect number of geocenters")
+		}
+		collapseCnt := 0
+		for _, x := range v.Results {
+			if x.Collapsed {
+				collapseCnt++
+			}
+		}
+		if collapseCnt != 33 {
+			return fmt.Errorf("incorrect number of collapsed results")
+		}
+		for _, x := range v.Results {
+			if !x.Escalated {
+				return fmt.Errorf("a result entry was not escalated")
+			}
+		}
+
+		// Locate the branch entry last created and validate alert
+		// generation
+		testStr := "user@host.com NEWCOUNTRY Taipei, Taiwan access from "
+		testStr += "118.163.10.187 (test) [deviation:12.5]"
+		testStr += " last activity was from Mountain View, United States "
+		testStr += "(10423 km away) within hour before"
+		var o objectResult
+		for _, x := range v.Results {
+			if x.Collapsed {
+				continue
+			}
+			if x.SourceIPV4 != "118.163.10.187" {
+				continue
+			}
+			o = x
+			break
+		}
+		ad, err := v.createAlertDetailsBranch(o.BranchID)
+		if err != nil {
+			return err
+		}
+		err = ad.addPreviousEvent(&v, o.BranchID)
+		if err != nil {
+			return err
+		}
+		err = ad.calculateSeverity()
+		if err != nil {
+			return err
+		}
+		// A new country is present, so we should have a severity of 2
+		if ad.Severity != 2 {
+			return fmt.Errorf("alert had incorrect severity")
+		}
+		if ad.Category != "NEWCOUNTRY" {
+			return fmt.Errorf("alert had incorrect category")
+		}
+		sumstr, err := ad.makeSummary()
+		if err != nil {
+			return err
+		}
+		if sumstr != testStr {
+			return fmt.Errorf("alert summary did not match")
+		}
+	}
+	return nil
+}
+
+func testtab5FuncPre() error {
+	s := getStateService().(*simpleStateService).getStore()
+	if len(s) != 1 {
+		return fmt.Errorf("more than one entry in state")
+	}
+	for _, v := range s {
+		if len(v.Results) != 10 {
+			return fmt.Errorf("incorrect number of stored results in pre func")
+		}
+	}
+	return nil
+}
+
+func testtab5FuncPost() error {
+	s := getStateService().(*simpleStateService).getStore()
+	if len(s) != 1 {
+		return fmt.Errorf("more than one entry in state")
+	}
+	for _, v := range s {
+		if len(v.Results) != 20 {
+			return fmt.Errorf("incorrect number of stored results in post func")
+		}
+		if v.NumCenters != 1 {
+			return fmt.Errorf("incorrect number of geocenters")
+		}
+	}
+	return nil
+}
+
+func testtab6FuncEntry1() error {
+	s := getStateService().(*simpleStateService).getStore()
+	if len(s) != 2 {
+		return fmt.Errorf("incorrect number of entries in state")
+	}
+	oid, err := getObjectID("user@host.com")
+	if err != nil {
+		return err
+	}
+	uhent := s[oid]
+	oid, err = getObjectID("login@host.org")
+	if err != nil {
+		return err
+	}
+	lhent := s[oid]
+	if len(uhent.Results) != 42 {
+		return fmt.Errorf("incorrect number of events for user@host.com in entry1")
+	}
+	if uhent.NumCenters != 2 {
+		return fmt.Errorf("incorrect number of geocenters for user@host.com in entry1")
+	}
+	if len(lhent.Results) != 40 {
+		return fmt.Errorf("incorrect number of events for login@host.org in entry1")
+	}
+	if lhent.NumCenters != 1 {
+		return fmt.Errorf("incorrect number of geocenters for login@host.org in entry1")
+	}
+
+	// Change the stored expiry duration value, which will result in some
+	// of the events entered in the previous phase being removed
+	cfg.Timer.ExpireEvents = "250h"
+	return nil
+}
+
+func testtab6FuncFinal() error {
+	s := getStateService().(*simpleStateService).getStore()
+	if len(s) != 2 {
+		return fmt.Errorf("incorrect number of entries in state")
+	}
+	oid, err := getObjectID("user@host.com")
+	if err != nil {
+		return err
+	}
+	uhent := s[oid]
+	oid, err = getObjectID("login@host.org")
+	if err != nil {
+		return err
+	}
+	lhent := s[oid]
+	if len(uhent.Results) != 55 {
+		return fmt.Errorf("incorrect number of events for user@host.com in final")
+	}
+	if len(lhent.Results) != 40 {
+		return fmt.Errorf("incorrect number of events for login@host.org in final")
+	}
+	return nil
+}
+
+func testtab7Func() error {
+	s := getStateService().(*simpleStateService).getStore()
+	if len(s) != 1 {
+		return fmt.Errorf("more than one entry in state")
+	}
+	for _, v := range s {
+		if v.WeightDeviation == 0 {
+			return fmt.Errorf("weight threshold was 0")
+		}
+		if v.NumCenters != 2 {
+			return fmt.Errorf("incorrect number of geocenters")
+		}
+		collapseCnt := 0
+		for _, x := range v.Results {
+			if x.Collapsed {
+				collapseCnt++
+			}
+		}
+		if collapseCnt != 18 {
+			return fmt.Errorf("incorrect number of collapsed results")
+		}
+		for _, x := range v.Results {
+			if !x.Escalated {
+				return fmt.Errorf("a result entry was not escalated")
+			}
+		}
+
+		// Locate the branch entry last created and validate alert
+		// generation
+		testStr := "user@host.com NEWLOCATION Louisville, United States access from "
+		testStr += "207.126.102.129 (test) [deviation:5]"
+		testStr += " last activity was from Mountain View, United States "
+		testStr += "(1490 km away) within hour before"
+		var o objectResult
+		for _, x := range v.Results {
+			if x.Collapsed {
+				continue
+			}
+			if x.SourceIPV4 != "207.126.102.129" {
+				continue
+			}
+			o = x
+			break
+		}
+		ad, err := v.createAlertDetailsBranch(o.BranchID)
+		if err != nil {
+			return err
+		}
+		err = ad.addPreviousEvent(&v, o.BranchID)
+		if err != nil {
+			return err
+		}
+		err = ad.calculateSeverity()
+		if err != nil {
+			return err
+		}
+		// This was a locality change in the same country, we should have
+		// a severity of 1
+		if ad.Severity != 1 {
+			return fmt.Errorf("alert had incorrect severity")
+		}
+		sumstr, err := ad.makeSummary()
+		if err != nil {
+			return err
+		}
+		if sumstr != testStr {
+			return fmt.Errorf("alert summary did not match")
+		}
+	}
+	return nil
+}
+
+func testtab8Func() error {
+	s := getStateService().(*simpleStateService).getStore()
+	if len(s) != 1 {
+		return fmt.Errorf("more than one entry in state")
+	}
+	for _, v := range s {
+		alert, err := v.analyzeUsageWithinWindow()
+		if err != nil {
+			return err
+		}
+		if len(alert) == 0 {
+			return fmt.Errorf("analyzeUsageWithinWindow did not return results")
+		}
+		ad, err := v.createAlertDetailsMovement(alert)
+		if err != nil {
+			return err
+		}
+		sumstr, err := ad.makeSummary()
+		if err != nil {
+			return err
+		}
+		testStr := "user@host.com MOVEMENT window violation "
+		testStr += "(Taipei, Taiwan) -> (Mountain View, United States) "
+		testStr += "within 4h window"
+		if sumstr != testStr {
+			return fmt.Errorf("alert summary did not match")
+		}
+	}
+	return nil
+}
+
+func testtab9Func() error {
+	s := getStateService().(*simpleStateService).getStore()
+	if len(s) != 1 {
+		return fmt.Errorf("more than one entry in state")
+	}
+	for _, v := range s {
+		// We should only have a single geocenter in the model since the unknown
+		// entry will have been discarded
+		if v.NumCenters != 1 {
+			return fmt.Errorf("incorrect number of geocenters")
+		}
+	}
+	return nil
+}
+
+func testtab10FuncPre() error {
+	cfg.exclusions = []exclusion{
+		{mustParseCIDR("63.245.214.0/24"), "scanner", exclusionNoAlert},
+		{mustParseCIDR("118.163.10.0/24"), "scanner", exclusionDrop},
+	}
+	e := eventResult{Name: "test", Principal: "user@host.com",
+		SourceIPV4: "10.0.0.1", Valid: true}
+	err := e.validate()
+	if err != nil {
+		return err
+	}
+	// 10.0.0.1 is not part of the configured exclusions, so should be valid
+	if !e.Valid || e.noAlert {
+		return fmt.Errorf("result was excluded")
+	}
+	e.SourceIPV4 = "63.245.214.133"
+	err = e.validate()
+	if err != nil {
+		return err
+	}
+	if !e.Valid || !e.noAlert {
+		return fmt.Errorf("result was not marked noalert")
+	}
+	return nil
+}
+
+func testtab10Func() error {
+	s := getStateService().(*simpleStateService).getStore()
+	if len(s) != 1 {
+		return fmt.Errorf("more than one entry in state")
+	}
+	for _, v := range s {
+		if len(v.Results) != 5 {
+			return fmt.Errorf("incorrect number of results")
+		}
+		for _, x := range v.Results {
+			if x.SourceIPV4 != "63.245.214.133" {
+				return fmt.Errorf("dropped result was present in model")
+			}
+			if !x.NoAlert {
+				return fmt.Errorf("a result entry was not marked noalert")
+			}
+			if x.Escalated {
+				return fmt.Errorf("a noalert result entry was escalated")
+			}
+		}
+	}
+	return nil
+}
+
+func testtab10FuncClear() error {
+	cfg.exclusions = nil
+	return nil
+}
+
+func testtab10FuncPost() error {
+	s := getStateService().(*simpleStateService).getStore()
+	for _, v := range s {
+		if len(v.Results) != 6 {
+			return fmt.Errorf("incorrect number of results")
+		}
+		noalert := 0
+		for _, x := range v.Results {
+			if x.NoAlert {
+				noalert++
+			}
+			// The login from outside the exclusion creates a new
+			// geocenter alert for the locality
+			if !x.Escalated {
+				return fmt.Errorf("a result entry was not escalated")
+			}
+		}
+		if noalert != 5 {
+			return fmt.Errorf("incorrect number of noalert results")
+		}
+	}
+	return nil
+}
+
+func testtab10FuncMove() error {
+	cfg.exclusions = []exclusion{
+		{mustParseCIDR("118.163.10.0/24"), "scanner", exclusionNoAlert},
+	}
+	return nil
+}
+
+func testtab10FuncMovePost() error {
+	s := getStateService().(*simpleStateService).getStore()
+	for _, v := range s {
+		if len(v.Results) != 7 {
+			return fmt.Errorf("incorrect number of results")
+		}
+		// The noalert login from Taipei must not be considered movement
+		// away from Mountain View
+		ret := v.analyzeWindow(time.Time{}, time.Now().UTC())
+		if len(ret) != 0 {
+			return fmt.Errorf("noalert result was used in movement analysis")
+		}
+		cfg.Geo.MaxSpeed = 900
+		ret = v.analyzeWindow(time.Time{}, time.Now().UTC())
+		cfg.Geo.MaxSpeed = 0
+		if len(ret) != 0 {
+			return fmt.Errorf("noalert result was used in velocity analysis")
+		}
+	}
+	return nil
+}
+
+func testtab11FuncPre() error {
+	ovr, err := parseOverride([]string{"10.1.0.0/16", "Toronto", "Canada",
+		"43.6319", "-79.3716", "", "", "ca"})
+	if err != nil {
+		return err
+	}
+	cfg.overrides = []override{ovr}
+	return nil
+}
+
+func testtab11Func() error {
+	s := getStateService().(*simpleStateService).getStore()
+	if len(s) != 1 {
+		return fmt.Errorf("more than one entry in state")
+	}
+	for _, v := range s {
+		// Only the overridden range should be present, 10.2.0.1 remains
+		// excluded
+		if len(v.Results) != 3 {
+			return fmt.Errorf("incorrect number of results")
+		}
+		for _, x := range v.Results {
+			if x.Locality.City != "Toronto" || x.Locality.Country != "Canada" ||
+				x.Locality.CountryCode != "CA" {
+				return fmt.Errorf("result did not use override locality")
+			}
+		}
+		if v.NumCenters != 1 {
+			return fmt.Errorf("incorrect number of geocenters")
+		}
+	}
+	return nil
+}
+
+func testtab12FuncPre() error {
+	cfg.torExitNodes = map[string]bool{"118.163.10.187": true}
+	return nil
+}
+
+func testtab12Func() error {
+	s := getStateService().(*simpleStateService).getStore()
+	if len(s) != 1 {
+		return fmt.Errorf("more than one entry in state")
+	}
+	for _, v := range s {
+		testStr := "user@host.com NEWCOUNTRY Taipei, Taiwan access from "
+		testStr += "118.163.10.187 (test) [anonymizer:tor] [deviation:7]"
+		testStr += " last activity was from Mountain View, United States "
+		testStr += "(10423 km away) within hour before"
+		var o objectResult
+		for _, x := range v.Results {
+			if x.Collapsed {
+				continue
+			}
+			if x.SourceIPV4 != "118.163.10.187" {
+				continue
+			}
+			o = x
+			break
+		}
+		if !o.isAnonymous(anonymousTor) {
+			return fmt.Errorf("result was not flagged as tor")
+		}
+		ad, err := v.createAlertDetailsBranch(o.BranchID)
+		if err != nil {
+			return err
+		}
+		err = ad.addPreviousEvent(&v, o.BranchID)
+		if err != nil {
+			return err
+		}
+		err = ad.calculateSeverity()
+		if err != nil {
+			return err
+		}
+		// New country with tor should result in a severity of 3
+		if ad.Severity != 3 {
+			return fmt.Errorf("alert had incorrect severity")
+		}
+		sumstr, err := ad.makeSummary()
+		if err != nil {
+			return err
+		}
+		if sumstr != testStr {
+			return fmt.Errorf("alert summary did not match")
+		}
+
+		// A later login through tor from the known locality is reported
+		// on its own
+		if len(v.anonymousResults) != 0 {
+			return fmt.Errorf("anonymizer results were not reset")
+		}
+		err = v.addEventResult(eventResult{Principal: v.ObjectIDString,
+			SourceIPV4: "118.163.10.187", Timestamp: time.Now().UTC(),
+			Valid: true, Name: "test"})
+		if err != nil {
+			return err
+		}
+		err = v.addEventResult(eventResult{Principal: v.ObjectIDString,
+			SourceIPV4: "63.245.214.133", Timestamp: time.Now().UTC(),
+			Valid: true, Name: "test"})
+		if err != nil {
+			return err
+		}
+		if len(v.anonymousResults) != 1 || v.anonymousResults[0].SourceIPV4 != "118.163.10.187" {
+			return fmt.Errorf("anonymizer login was not identified")
+		}
+		var rd alertDetailsBranch
+		rd.fromResult(&v, v.anonymousResults[0])
+		rd.Category = "ANONYMIZER"
+		sumstr, err = rd.makeSummary()
+		if err != nil {
+			return err
+		}
+		if !strings.HasSuffix(sumstr, "[anonymizer:tor], anonymizer used within known locality") {
+			return fmt.Errorf("incorrect summary %v", sumstr)
+		}
+	}
+	return nil
+}
+
+func testtab13FuncPre() error {
+	s := getStateService().(*simpleStateService).getStore()
+	// Simulate a database update that moves the address block by marking the
+	// stored state as geolocated with a different database, and using an
+	// override to change the locality of the address
+	for k, v := range s {
+		if v.MaxMindEpoch != maxmindEpoch() {
+			return fmt.Errorf("state did not record maxmind epoch")
+		}
+		v.MaxMindEpoch = v.MaxMindEpoch + 1
+		s[k] = v
+	}
+	cfg.Geo.Regeolocate = true
+	ovr, err := parseOverride([]string{"63.245.214.0/24", "Taipei", "Taiwan",
+		"25.0478", "121.48"})
+	if err != nil {
+		return err
+	}
+	cfg.overrides = []override{ovr}
+	return nil
+}
+
+func testtab13Func() error {
+	s := getStateService().(*simpleStateService).getStore()
+	if len(s) != 1 {
+		return fmt.Errorf("more than one entry in state")
+	}
+	for _, v := range s {
+		if len(v.Results) != 11 {
+			return fmt.Errorf("incorrect number of results")
+		}
+		if v.NumCenters != 1 {
+			return fmt.Errorf("incorrect number of geocenters")
+		}
+		for _, x := range v.Results {
+			if x.Locality.City != "Taipei" {
+				return fmt.Errorf("result was not re-geolocated")
+			}
+			if !x.Escalated {
+				return fmt.Errorf("a result entry was not escalated")
+			}
+		}
+	}
+	return nil
+}
+
+func testtab14Func() error {
+	now := time.Now().UTC()
+	var o object
+	o.newFromPrincipal("user@host.com")
+	// A precise result in Mountain View, and an imprecise result whose
+	// accuracy radius overlaps with it
+	o.Results = []objectResult{
+		{BranchID: "a", Latitude: 37.3845, Longitude: -122.0881,
+			AccuracyRadius: 5, Timestamp: now.Add(-1 * time.Hour),
+			Locality: Locality{City: "Mountain View", Country: "United States"}},
+		{BranchID: "b", Latitude: 38.0, Longitude: -112.0,
+			AccuracyRadius: 1000, Timestamp: now,
+			Locality: Locality{City: "Unknown", Country: "United States"}},
+	}
+	err := geoFlatten(&o)
+	if err != nil {
+		return err
+	}
+	err = geoCollapse(&o)
+	if err != nil {
+		return err
+	}
+	if o.NumCenters != 1 {
+		return fmt.Errorf("imprecise result was not collapsed")
+	}
+
+	// Place the imprecise result in another country far enough away that it
+	// would violate the movement distance without the accuracy radius
+	o.Results[1].Latitude = 49.9
+	o.Results[1].Longitude = -97.1
+	o.Results[1].Locality.Country = "Canada"
+	o.Results[1].AccuracyRadius = 1000
+	err = geoFlatten(&o)
+	if err != nil {
+		return err
+	}
+	err = geoCollapse(&o)
+	if err != nil {
+		return err
+	}
+	if o.NumCenters != 2 {
+		return fmt.Errorf("incorrect number of geocenters")
+	}
+	alert, err := o.analyzeUsageWithinWindow()
+	if err != nil {
+		return err
+	}
+	if len(alert) != 0 {
+		return fmt.Errorf("movement alert created for imprecise result")
+	}
+	o.Results[1].AccuracyRadius = 5
+	alert, err = o.analyzeUsageWithinWindow()
+	if err != nil {
+		return err
+	}
+	if len(alert) == 0 {
+		return fmt.Errorf("movement alert not created for precise result")
+	}
+
+	// An escalated result resolving only to the country centroid must not
+	// make a precise result within its accuracy radius known
+	o.Results = []objectResult{
+		{BranchID: "a", Latitude: 39.8, Longitude: -98.6,
+			AccuracyRadius: 1000, Timestamp: now.Add(-1 * time.Hour),
+			Escalated: true, Locality: Locality{Country: "United States"}},
+		{BranchID: "b", Latitude: 41.88, Longitude: -87.63,
+			AccuracyRadius: 5, Timestamp: now,
+			Locality: Locality{City: "Chicago", Country: "United States"}},
+	}
+	err = geoFlatten(&o)
+	if err != nil {
+		return err
+	}
+	err = geoCollapse(&o)
+	if err != nil {
+		return err
+	}
+	if o.Results[1].Collapsed || o.Results[0].CollapseBranch != "b" {
+		return fmt.Errorf("imprecise result was used as a locality center")
+	}
+	if o.Results[1].Escalated {
+		return fmt.Errorf("imprecise result escalated a precise locality")
+	}
+	return nil
+}
+
+func testtab15Func() error {
+	fd, err := ioutil.TempFile("", "overrides")
+	if err != nil {
+		return err
 	}
-	return &r, nil
+	defer os.Remove(fd.Name())
+	buf := "# CIDR,City,Country,Latitude,Longitude,Label,Expiry\n"
+	buf += "\n"
+	buf += "10.0.0.0/8,Toronto,Canada,43.6319,-79.3716\n"
+	buf += "10.1.0.0/16,\"Washington, D.C.\",United States,38.9072,-77.0369,dc-office\n"
+	buf += "10.2.0.0/16,Paris,France,48.8566,2.3522,paris-office,2001-01-01\n"
+	buf += "2001:db8::/32,Berlin,Germany,52.5200,13.4050,berlin-vpn,\n"
+	buf += "2001:db9::/32,Berlin,Germany,52.5200,13.4050,berlin-vpn,,DE\n"
+	_, err = fd.WriteString(buf)
+	fd.Close()
+	if err != nil {
+		return err
+	}
+	cfg.overrides, err = readOverrides(fd.Name())
+	if err != nil {
+		return err
+	}
+	if len(cfg.overrides) != 5 {
+		return fmt.Errorf("incorrect number of overrides")
+	}
+	ovr := findOverride(net.ParseIP("10.1.2.3"))
+	if ovr == nil || ovr.city != "Washington, D.C." || ovr.label != "dc-office" {
+		return fmt.Errorf("longest prefix override was not returned")
+	}
+	// The more specific entry has expired, so the /8 should be used
+	ovr = findOverride(net.ParseIP("10.2.2.3"))
+	if ovr == nil || ovr.city != "Toronto" {
+		return fmt.Errorf("expired override was returned")
+	}
+	ovr = findOverride(net.ParseIP("2001:db8::1"))
+	if ovr == nil || ovr.city != "Berlin" {
+		return fmt.Errorf("ipv6 override was not returned")
+	}
+	ovr = findOverride(net.ParseIP("2001:db9::1"))
+	if ovr == nil || ovr.countryCode != "DE" {
+		return fmt.Errorf("override country code was not returned")
+	}
+	if findOverride(net.ParseIP("192.168.0.1")) != nil {
+		return fmt.Errorf("override returned for unmatched address")
+	}
+
+	// Invalid CIDRs should be identified when the file is read
+	fd, err = ioutil.TempFile("", "overrides")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(fd.Name())
+	_, err = fd.WriteString("10.0.0.0/33,Toronto,Canada,43.6319,-79.3716\n")
+	fd.Close()
+	if err != nil {
+		return err
+	}
+	_, err = readOverrides(fd.Name())
+	if err == nil {
+		return fmt.Errorf("invalid cidr in overrides was not identified")
+	}
+	return nil
 }
 
-func (s *simpleStateService) writeObject(o object) (err error) {
-	s.store[o.ObjectID] = o
+func testtab16FuncPre() error {
+	cfg.General.Language = "fr"
+	return nil
+}
+
+func testtab16Func() error {
+	s := getStateService().(*simpleStateService).getStore()
+	if len(s) != 1 {
+		return fmt.Errorf("more than one entry in state")
+	}
+	for _, v := range s {
+		l := v.Results[0].Locality
+		if l.Country != "États-Unis" {
+			return fmt.Errorf("country name did not use configured language")
+		}
+		if l.CountryCode != "US" || l.Continent != "NA" {
+			return fmt.Errorf("incorrect country or continent code")
+		}
+		if l.SubdivisionCode != "CA" {
+			return fmt.Errorf("incorrect subdivision code")
+		}
+		l2 := Locality{City: "Unknown", Country: "United States",
+			CountryCode: "US", Subdivision: "California"}
+		if !l.sameCountry(l2) {
+			return fmt.Errorf("localities were not in the same country")
+		}
+		lval, err := l2.assemble()
+		if err != nil {
+			return err
+		}
+		if lval != "California, United States" {
+			return fmt.Errorf("subdivision was not used for unknown city")
+		}
+	}
+	return nil
+}
+
+func testtab17FuncPre() error {
+	cfg.Geo.UnknownCountry = unknownCountryKeep
+	return nil
+}
+
+func testtab17Func() error {
+	s := getStateService().(*simpleStateService).getStore()
+	if len(s) != 1 {
+		return fmt.Errorf("more than one entry in state")
+	}
+	for _, v := range s {
+		if len(v.Results) != 3 {
+			return fmt.Errorf("unknown result was not stored")
+		}
+		cnt := 0
+		for _, x := range v.Results {
+			if !x.Ungeolocated {
+				continue
+			}
+			cnt++
+			if x.SourceIPV4 != "255.255.255.255" {
+				return fmt.Errorf("incorrect result flagged as ungeolocated")
+			}
+			if !x.Escalated {
+				return fmt.Errorf("ungeolocated result was not escalated")
+			}
+		}
+		if cnt != 1 {
+			return fmt.Errorf("incorrect number of ungeolocated results")
+		}
+		// The unknown result has no location, so it should not form a
+		// geocenter
+		if v.NumCenters != 1 {
+			return fmt.Errorf("incorrect number of geocenters")
+		}
+	}
+	return nil
+}
+
+func testtab18FuncPre() error {
+	cfg.Geo.MaxSpeed = 1000
+	return nil
+}
+
+func testtab18FuncPlausible() error {
+	s := getStateService().(*simpleStateService).getStore()
+	if len(s) != 1 {
+		return fmt.Errorf("more than one entry in state")
+	}
+	for _, v := range s {
+		// 1490 km in two hours is possible
+		alert, err := v.analyzeUsageWithinWindow()
+		if err != nil {
+			return err
+		}
+		if len(alert) != 0 {
+			return fmt.Errorf("movement alert created for plausible travel")
+		}
+	}
+	return nil
+}
+
+func testtab18FuncImpossible() error {
+	s := getStateService().(*simpleStateService).getStore()
+	if len(s) != 1 {
+		return fmt.Errorf("more than one entry in state")
+	}
+	for _, v := range s {
+		// 1490 km in five minutes is not, even though the distance is less
+		// than the movement distance
+		alert, err := v.analyzeUsageWithinWindow()
+		if err != nil {
+			return err
+		}
+		if len(alert) != 2 {
+			return fmt.Errorf("analyzeUsageWithinWindow did not return path")
+		}
+		ad, err := v.createAlertDetailsMovement(alert)
+		if err != nil {
+			return err
+		}
+		if ad.Elapsed != "5m0s" {
+			return fmt.Errorf("alert had incorrect elapsed time")
+		}
+		if ad.Speed <= float64(cfg.Geo.MaxSpeed) {
+			return fmt.Errorf("alert had incorrect speed")
+		}
+		sumstr, err := ad.makeSummary()
+		if err != nil {
+			return err
+		}
+		testStr := "user@host.com MOVEMENT impossible travel "
+		testStr += "(Louisville, United States) -> (Mountain View, United States) "
+		if !strings.HasPrefix(sumstr, testStr) {
+			return fmt.Errorf("alert summary did not match")
+		}
+	}
+
+	// A locality the path passes through is only included once, even if
+	// the path leaves it from a different event than it arrived at
+	now := time.Now().UTC()
+	resl := objectResults{
+		{BranchID: "a", Latitude: 38.25, Longitude: -85.76,
+			Timestamp: now.Add(-3 * time.Hour)},
+		{BranchID: "b1", Latitude: 37.38, Longitude: -122.08,
+			Timestamp: now.Add(-2 * time.Hour)},
+		{BranchID: "b2", Latitude: 37.38, Longitude: -122.08,
+			Timestamp: now.Add(-1 * time.Hour), Collapsed: true,
+			CollapseBranch: "b1"},
+		{BranchID: "c", Latitude: 25.04, Longitude: 121.5,
+			Timestamp: now.Add(-59 * time.Minute)},
+	}
+	path := analyzeVelocity(resl, 100)
+	if len(path) != 3 || path[0].BranchID != "a" || path[1].BranchID != "b1" ||
+		path[2].BranchID != "c" {
+		return fmt.Errorf("incorrect movement path")
+	}
+	return nil
+}
+
+func testtab19Func() error {
+	s := getStateService().(*simpleStateService).getStore()
+	if len(s) != 1 {
+		return fmt.Errorf("more than one entry in state")
+	}
+	for _, v := range s {
+		// With no new results the window ends at the latest event, which
+		// does not contain the movement
+		alert, err := v.analyzeUsageWithinWindow()
+		if err != nil {
+			return err
+		}
+		if len(alert) != 0 {
+			return fmt.Errorf("movement alert created for latest window")
+		}
+		// Treat all results as being newly merged, the historical movement
+		// should be identified
+		for _, x := range v.Results {
+			v.newResultTimes = append(v.newResultTimes, x.Timestamp)
+		}
+		alert, err = v.analyzeUsageWithinWindow()
+		if err != nil {
+			return err
+		}
+		if len(alert) != 2 {
+			return fmt.Errorf("movement alert not created for historical events")
+		}
+		if alert[1].Locality.City != "Taipei" {
+			return fmt.Errorf("incorrect locality in movement alert")
+		}
+	}
+	return nil
+}
+
+func testtab20FuncPre() error {
+	cfg.Geo.LearningEvents = 10
+	cfg.Geo.LearningPeriod = "24h"
+	return nil
+}
+
+func testtab20FuncLearning() error {
+	s := getStateService().(*simpleStateService).getStore()
+	if len(s) != 1 {
+		return fmt.Errorf("more than one entry in state")
+	}
+	for _, v := range s {
+		if v.EventCount != 5 {
+			return fmt.Errorf("incorrect event count")
+		}
+		if time.Now().UTC().Sub(v.FirstSeen) < 47*time.Hour {
+			return fmt.Errorf("incorrect first seen value")
+		}
+		if !v.inLearning(time.Now().UTC()) {
+			return fmt.Errorf("principal was not in learning period")
+		}
+		if v.shouldAlert(time.Now().UTC()) {
+			return fmt.Errorf("alert would be sent during learning period")
+		}
+		// Movement is subject to the learning period, unless it involves
+		// a country the policy always alerts on
+		cfg.noSendAlert = false
+		learning := v.shouldAlertMovement(v.Results)
+		cfg.countryPolicies = map[string]countryPolicy{
+			"US": {countryCode: "US", alwaysAlert: true},
+		}
+		always := v.shouldAlertMovement(v.Results)
+		cfg.noSendAlert = true
+		cfg.countryPolicies = nil
+		if learning {
+			return fmt.Errorf("movement alert would be sent during learning period")
+		}
+		if !always {
+			return fmt.Errorf("movement alert for high-risk country was not sent")
+		}
+	}
+	return nil
+}
+
+func testtab20FuncLearned() error {
+	s := getStateService().(*simpleStateService).getStore()
+	if len(s) != 1 {
+		return fmt.Errorf("more than one entry in state")
+	}
+	for _, v := range s {
+		if v.EventCount != 10 {
+			return fmt.Errorf("incorrect event count")
+		}
+		if v.inLearning(time.Now().UTC()) {
+			return fmt.Errorf("principal was in learning period")
+		}
+		// The first events are still within the learning period
+		if !v.inLearning(v.FirstSeen.Add(time.Hour)) {
+			return fmt.Errorf("principal was not in learning period")
+		}
+	}
+	return nil
+}
+
+func testtab21FuncPre() error {
+	fd, err := ioutil.TempFile("", "geomodel")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(fd.Name())
+	fmt.Fprintf(fd, "# principal,city,country,latitude,longitude\n")
+	fmt.Fprintf(fd, "user@host.com,Taipei,Taiwan,25.0478,121.5319\n")
+	fmt.Fprintf(fd, "other@host.com,10.0.0.0/8\n")
+	fd.Close()
+	cfg.homeLocations, err = readHomeLocations(fd.Name())
+	if err != nil {
+		return err
+	}
+	if len(cfg.homeLocations) != 2 {
+		return fmt.Errorf("incorrect number of principals in home locations")
+	}
+	_, _, err = parseHomeLocation([]string{"user@host.com", "Taipei", "Taiwan"})
+	if err == nil {
+		return fmt.Errorf("invalid home location was accepted")
+	}
+	return nil
+}
+
+func testtab21Func() error {
+	s := getStateService().(*simpleStateService).getStore()
+	if len(s) != 1 {
+		return fmt.Errorf("more than one entry in state")
+	}
+	for _, v := range s {
+		anchors := 0
+		for _, x := range v.Results {
+			if x.Anchor {
+				anchors++
+				continue
+			}
+			// The login from Taipei should have been treated as known, the
+			// login from Mountain View is a new geocenter
+			if x.SourceIPV4 == "118.163.10.187" {
+				if !x.Collapsed || x.CollapseBranch != "home-0" {
+					return fmt.Errorf("result was not collapsed into home location")
+				}
+			}
+		}
+		if anchors != 1 {
+			return fmt.Errorf("incorrect number of anchor results")
+		}
+		if len(v.Results) != 3 {
+			return fmt.Errorf("incorrect number of results")
+		}
+		if v.NumCenters != 2 {
+			return fmt.Errorf("incorrect number of geocenters")
+		}
+		if v.EventCount != 2 {
+			return fmt.Errorf("incorrect event count")
+		}
+	}
+	return nil
+}
+
+func testtab21FuncEpoch() error {
+	s := getStateService().(*simpleStateService).getStore()
+	// Simulate a database update with home locations configured
+	for k, v := range s {
+		v.MaxMindEpoch = v.MaxMindEpoch + 1
+		s[k] = v
+	}
+	cfg.Geo.Regeolocate = true
+	return nil
+}
+
+func testtab21FuncRegeo() error {
+	s := getStateService().(*simpleStateService).getStore()
+	if len(s) != 1 {
+		return fmt.Errorf("more than one entry in state")
+	}
+	for _, v := range s {
+		if v.MaxMindEpoch != maxmindEpoch() {
+			return fmt.Errorf("state did not record maxmind epoch")
+		}
+		anchors := 0
+		for _, x := range v.Results {
+			if x.Anchor {
+				anchors++
+				if x.Locality.City != "Taipei" {
+					return fmt.Errorf("anchor was re-geolocated")
+				}
+			}
+		}
+		if anchors != 1 {
+			return fmt.Errorf("incorrect number of anchor results")
+		}
+		if v.EventCount != 3 {
+			return fmt.Errorf("incorrect event count")
+		}
+	}
 	return nil
 }
 
-func (s *simpleStateService) doInit() (err error) {
-	s.store = make(map[string]object)
+func testtab22FuncPre() error {
+	cfg.Geo.HistoryRetention = "8760h"
 	return nil
 }
 
-func (s *simpleStateService) getStore() map[string]object {
-	return s.store
+func testtab22Func() error {
+	s := getStateService().(*simpleStateService).getStore()
+	if len(s) != 1 {
+		return fmt.Errorf("more than one entry in state")
+	}
+	for _, v := range s {
+		// The initial events have expired, but are retained in the
+		// history summary
+		if len(v.Results) != 2 {
+			return fmt.Errorf("incorrect number of results")
+		}
+		if len(v.History.Countries) != 2 || len(v.History.Localities) != 2 {
+			return fmt.Errorf("incorrect history summary")
+		}
+		for _, x := range v.History.Localities {
+			if x.Locality.City == "Taipei" && x.Count != 4 {
+				return fmt.Errorf("incorrect history count for locality")
+			}
+		}
+		var branchID string
+		for _, x := range v.Results {
+			if x.SourceIPV4 != "118.163.10.187" {
+				continue
+			}
+			if !x.Escalated {
+				return fmt.Errorf("result in remembered locality was not escalated")
+			}
+			branchID = x.BranchID
+		}
+		// The previous event is in a different country, but the country
+		// is known from the history summary
+		ad, err := v.createAlertDetailsBranch(branchID)
+		if err != nil {
+			return err
+		}
+		err = ad.addPreviousEvent(&v, branchID)
+		if err != nil {
+			return err
+		}
+		ad.addHistory(&v, branchID)
+		err = ad.calculateSeverity()
+		if err != nil {
+			return err
+		}
+		if ad.Severity != 1 || ad.Category != "NEWLOCATION" {
+			return fmt.Errorf("country in history summary was treated as new")
+		}
+		v.History.prune(time.Now().UTC().Add(-500 * time.Hour))
+		if len(v.History.Countries) != 2 {
+			return fmt.Errorf("history summary pruned incorrectly")
+		}
+		v.History.prune(time.Now().UTC())
+		if len(v.History.Countries) != 0 || len(v.History.Localities) != 0 {
+			return fmt.Errorf("history summary was not pruned")
+		}
+	}
+	return nil
 }
 
-func makePhaseResults(tp []testEvent) (pluginResult, error) {
-	var ret pluginResult
-
-	ret.Results = make([]eventResult, 0)
-	for i := range tp {
-		for j := 1; j <= tp[i].n; j++ {
-			newres := eventResult{}
-			newres.Timestamp = time.Now().UTC()
-			if tp[i].durationSub != "" {
-				dur, err := time.ParseDuration(tp[i].durationSub)
-				if err != nil {
-					return ret, err
-				}
-				newres.Timestamp = newres.Timestamp.Add(-1 * dur)
+func testtab23Func() error {
+	s := getStateService().(*simpleStateService).getStore()
+	if len(s) != 1 {
+		return fmt.Errorf("more than one entry in state")
+	}
+	for _, v := range s {
+		var branchID string
+		for _, x := range v.Results {
+			if x.SourceIPV4 == "63.245.214.133" {
+				branchID = x.BranchID
 			}
-			newres.Principal = tp[i].p
-			newres.SourceIPV4 = tp[i].srcip
-			newres.Name = "test"
-			newres.Valid = true
-			err := newres.validate()
+		}
+		newDetails := func() (alertDetailsBranch, error) {
+			ad, err := v.createAlertDetailsBranch(branchID)
 			if err != nil {
-				return ret, err
+				return ad, err
 			}
-			ret.Results = append(ret.Results, newres)
+			err = ad.addPreviousEvent(&v, branchID)
+			if err != nil {
+				return ad, err
+			}
+			ad.addHistory(&v, branchID)
+			err = ad.calculateSeverity()
+			return ad, err
 		}
-	}
-
-	return ret, nil
-}
 
-func runTestPhase(tp testPhase) error {
-	switch tp.phaseType {
-	case EVENT:
-		ev, err := makePhaseResults(tp.events)
+		// The previous event is from Taipei, but the principal has been
+		// in the United States before
+		ad, err := newDetails()
 		if err != nil {
 			return err
 		}
-		integrate(ev)
-		err = integrationMergeQueue()
+		if ad.PrevLocality.City != "Taipei" {
+			return fmt.Errorf("unexpected previous event")
+		}
+		if !ad.CountryKnown || ad.Severity != 1 || ad.Category != "NEWLOCATION" {
+			return fmt.Errorf("known country was treated as new")
+		}
+
+		cfg.Geo.CountryRecency = "4h"
+		ad, err = newDetails()
 		if err != nil {
 			return err
 		}
-	case FUNC:
-		err := tp.chkFunc()
+		if ad.Severity != 2 || ad.Category != "NEWLOCATION" {
+			return fmt.Errorf("incorrect severity for stale country")
+		}
+		sum, err := ad.makeSummary()
 		if err != nil {
 			return err
 		}
-	}
-	return nil
-}
+		if !strings.Contains(sum, " [country last seen ") {
+			return fmt.Errorf("summary did not indicate stale country")
+		}
 
-func runTestTable(testtab testTable, t *testing.T) {
-	defer func() {
-		if e := recover(); e != nil {
-			t.Fatalf("test failed: %v", e)
+		cfg.Geo.GeocenterDistance = 1000
+		ad, err = newDetails()
+		if err != nil {
+			return err
 		}
-	}()
+		if ad.GeocenterDistance < 1000 || ad.Severity != 3 {
+			return fmt.Errorf("incorrect severity for distance from geocenter")
+		}
+	}
 
-	err := testGenericInit()
+	// A country not in the history summary is new even if the principal has
+	// no previous event
+	cfg.Geo.CountryRecency = ""
+	cfg.Geo.GeocenterDistance = 0
+	var o object
+	o.History.Countries = []historyCountry{{Country: "Taiwan", CountryCode: "TW"}}
+	ad := alertDetailsBranch{Locality: Locality{City: "Mountain View",
+		Country: "United States", CountryCode: "US"}}
+	ad.addHistory(&o, "a")
+	err := ad.calculateSeverity()
 	if err != nil {
-		panic(err)
+		return err
 	}
-	for i := range testtab {
-		err := runTestPhase(testtab[i])
-		if err != nil {
-			panic(err)
-		}
+	if ad.Severity != 2 || ad.Category != "NEWCOUNTRY" {
+		return fmt.Errorf("country not in history was not treated as new")
 	}
+	return nil
 }
 
-func testGenericInit() error {
-	cfg.General.MaxMind = os.Getenv("TESTMMF")
-	cfg.Geo.CollapseMaximum = 500
-	cfg.Geo.MovementDistance = 2000
-	cfg.Geo.MovementWindow = "4h"
-	cfg.Timer.ExpireEvents = "720h"
-	cfg.noSendAlert = true
-	err := maxmindInit()
+func testtab24FuncPre() error {
+	fd, err := ioutil.TempFile("", "geomodel")
 	if err != nil {
 		return err
 	}
-	setStateService(&simpleStateService{})
-	getStateService().(*simpleStateService).doInit()
+	defer os.Remove(fd.Name())
+	fmt.Fprintf(fd, "# CountryCode,Adjustment[,alwaysalert]\n")
+	fmt.Fprintf(fd, "tw,3,alwaysalert\n")
+	fmt.Fprintf(fd, "CA,-1\n")
+	fd.Close()
+	cfg.countryPolicies, err = readCountryPolicies(fd.Name())
+	if err != nil {
+		return err
+	}
+	if len(cfg.countryPolicies) != 2 {
+		return fmt.Errorf("incorrect number of country policies")
+	}
+	if !countryAlwaysAlert(Locality{CountryCode: "TW"}) {
+		return fmt.Errorf("country policy was not applied")
+	}
+	_, err = parseCountryPolicy([]string{"TW", "3", "sometimes"})
+	if err == nil {
+		return fmt.Errorf("invalid country policy was accepted")
+	}
 	return nil
 }
 
-func testtab0Func() error {
+func testtab24Func() error {
 	s := getStateService().(*simpleStateService).getStore()
-	cnt := len(s)
-	if cnt != 1 {
+	if len(s) != 1 {
 		return fmt.Errorf("more than one entry in state")
 	}
 	for _, v := range s {
-		if len(v.Results) != 1 {
-			panic("more than one result in state entry")
+		var o objectResult
+		for _, x := range v.Results {
+			if x.SourceIPV4 == "118.163.10.187" {
+				o = x
+			}
 		}
-		if v.Results[0].SourceIPV4 != "63.245.214.133" {
-			panic("result we had was not the correct one")
+		ad, err := v.createAlertDetailsBranch(o.BranchID)
+		if err != nil {
+			return err
+		}
+		err = ad.addPreviousEvent(&v, o.BranchID)
+		if err != nil {
+			return err
+		}
+		err = ad.calculateSeverity()
+		if err != nil {
+			return err
+		}
+		if ad.Severity != 5 || ad.Category != "NEWCOUNTRY" {
+			return fmt.Errorf("country policy not applied to branch severity")
+		}
+		sum, err := ad.makeSummary()
+		if err != nil {
+			return err
+		}
+		if !strings.Contains(sum, " [high-risk country]") {
+			return fmt.Errorf("summary did not indicate high-risk country")
+		}
+
+		alertlist, err := v.analyzeUsageWithinWindow()
+		if err != nil {
+			return err
+		}
+		if len(alertlist) == 0 {
+			return fmt.Errorf("no movement alert was created")
+		}
+		md, err := v.createAlertDetailsMovement(alertlist)
+		if err != nil {
+			return err
+		}
+		md.calculateSeverity()
+		if md.Severity != 6 {
+			return fmt.Errorf("country policy not applied to movement severity")
+		}
+
+		// The high-risk country bypasses the movement alert dedupe only
+		// for a login added during the merge that has not been reported
+		if !v.movementAlertDue(alertlist) {
+			return fmt.Errorf("first movement alert was not sent")
+		}
+		if v.movementAlertDue(alertlist) {
+			return fmt.Errorf("movement alert for known results was sent again")
+		}
+		v.newResultTimes = []time.Time{o.Timestamp}
+		if v.movementAlertDue(alertlist) {
+			return fmt.Errorf("movement alert for reported result was sent again")
+		}
+		v.LastMoveAlert = o.Timestamp.Add(-1 * time.Minute)
+		if !v.movementAlertDue(alertlist) {
+			return fmt.Errorf("movement alert for new high-risk login was not sent")
 		}
 	}
 	return nil
 }
 
-func testtab1Func() error {
+func testtab25FuncPre() error {
+	var c config
+	err := gcfg.ReadStringInto(&c, `
+[group "finance"]
+principals = "^.*@finance\\.host\\.com$"
+allowedcountries = US, CA
+collapsemaximum = 20000
+movementwindow = 1h
+`)
+	if err != nil {
+		return err
+	}
+	cfg.groups, err = loadGroups(c.Group)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func testtab25Func() error {
 	s := getStateService().(*simpleStateService).getStore()
+	if len(s) != 2 {
+		return fmt.Errorf("incorrect number of entries in state")
+	}
 	for _, v := range s {
-		if v.WeightDeviation != 0 {
-			return fmt.Errorf("weight deviation was not 0")
+		if v.ObjectIDString == "user@host.com" {
+			if v.group != nil || v.NumCenters != 2 {
+				return fmt.Errorf("principal outside group used group policy")
+			}
+			continue
 		}
+		if v.group == nil || v.group.name != "finance" {
+			return fmt.Errorf("principal was not a member of group")
+		}
+		// The group collapse maximum places both localities in the same
+		// geocenter
 		if v.NumCenters != 1 {
-			return fmt.Errorf("incorrect number of geocenters")
+			return fmt.Errorf("group collapse maximum was not applied")
+		}
+		if v.movementWindow() != "1h" || v.movementDistance() != 2000 {
+			return fmt.Errorf("incorrect group movement thresholds")
+		}
+		// An override with no country code can't be evaluated
+		if !v.group.countryAllowed(Locality{City: "Toronto", Country: "Canada"}) {
+			return fmt.Errorf("locality with no country code was not allowed")
+		}
+		for _, x := range v.Results {
+			allowed := v.group.countryAllowed(x.Locality)
+			if x.Locality.Country == "Taiwan" && allowed {
+				return fmt.Errorf("country was allowed for group")
+			}
+			if x.Locality.Country == "United States" && !allowed {
+				return fmt.Errorf("country was not allowed for group")
+			}
+			if x.Locality.Country != "Taiwan" {
+				continue
+			}
+			var ad alertDetailsBranch
+			ad.fromResult(&v, x)
+			ad.Category = "POLICYVIOLATION"
+			sum, err := ad.makeSummary()
+			if err != nil {
+				return err
+			}
+			if !strings.HasSuffix(sum, ", country not allowed for group finance") {
+				return fmt.Errorf("incorrect policy violation summary: %v", sum)
+			}
+		}
+	}
+	return nil
+}
+
+func testtab26Cluster(o *object) (map[string]string, error) {
+	err := geoFlatten(o)
+	if err != nil {
+		return nil, err
+	}
+	err = geoCollapse(o)
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[string]string)
+	for _, x := range o.Results {
+		ret[x.SourceIPV4] = x.branch()
+	}
+	return ret, nil
+}
+
+func testtab26Func() error {
+	now := time.Now().UTC()
+	cfg.Geo.CollapseMaximum = 1000
+	// Las Vegas is within collapsemaximum of both Mountain View and
+	// Louisville, which are not within collapsemaximum of each other
+	results := []objectResult{
+		{BranchID: "a", SourceIPV4: "a", Latitude: 37.3845, Longitude: -122.0881,
+			Timestamp: now.Add(-3 * time.Hour), newResult: true},
+		{BranchID: "b", SourceIPV4: "b", Latitude: 39.9778, Longitude: -105.24,
+			Timestamp: now.Add(-2 * time.Hour), newResult: true},
+		{BranchID: "c", SourceIPV4: "c", Latitude: 36.17, Longitude: -115.14,
+			Timestamp: now.Add(-1 * time.Hour), newResult: true},
+		{BranchID: "d", SourceIPV4: "d", Latitude: 37.33, Longitude: -121.89,
+			Timestamp: now, newResult: true},
+	}
+	var o1, o2 object
+	o1.Results = append(o1.Results, results...)
+	o2.Results = append(o2.Results, results[3], results[2], results[1], results[0])
+	c1, err := testtab26Cluster(&o1)
+	if err != nil {
+		return err
+	}
+	c2, err := testtab26Cluster(&o2)
+	if err != nil {
+		return err
+	}
+	if o1.NumCenters != 2 || o2.NumCenters != 2 {
+		return fmt.Errorf("incorrect number of geocenters")
+	}
+	for k, v := range c1 {
+		if c2[k] != v {
+			return fmt.Errorf("clustering depends on result order")
+		}
+	}
+	if c1["c"] != "a" {
+		return fmt.Errorf("result was not collapsed into nearest locality")
+	}
+
+	// If the center of a locality expires, the locality keeps its ID
+	o1.Results = o1.Results[1:]
+	c1, err = testtab26Cluster(&o1)
+	if err != nil {
+		return err
+	}
+	if c1["d"] != "a" || c1["b"] != "b" {
+		return fmt.Errorf("locality ID was not retained")
+	}
+
+	// Escalation is retained when localities merge
+	o1.Results[1].Escalated = true
+	cfg.Geo.CollapseMaximum = 2000
+	_, err = testtab26Cluster(&o1)
+	if err != nil {
+		return err
+	}
+	if o1.NumCenters != 1 {
+		return fmt.Errorf("localities were not merged")
+	}
+	for _, x := range o1.Results {
+		if !x.Escalated {
+			return fmt.Errorf("escalation was not retained in merged locality")
+		}
+	}
+	return nil
+}
+
+func testtab27FuncPre() error {
+	cfg.Geo.CompactEvents = true
+
+	// Compacting results should not change the geocenter
+	now := time.Now().UTC()
+	var o object
+	add := func(ip string, lat float64, lon float64, ago time.Duration, n int) {
+		for i := 0; i < n; i++ {
+			o.Results = append(o.Results, objectResult{BranchID: fmt.Sprintf("%v-%v", ip, i),
+				SourceIPV4: ip, Latitude: lat, Longitude: lon,
+				Timestamp: now.Add(-1 * ago), SourcePlugin: "test"})
+		}
+	}
+	add("a", 37.3845, -122.0881, 10*time.Hour, 5)
+	add("b", 37.33, -121.89, 10*time.Hour, 3)
+	add("c", 25.0478, 121.48, 10*time.Hour, 2)
+	add("a", 37.3845, -122.0881, 0, 1)
+	geocenter := func() (objectGeocenter, error) {
+		err := geoFlatten(&o)
+		if err != nil {
+			return objectGeocenter{}, err
 		}
+		err = geoCollapse(&o)
+		if err != nil {
+			return objectGeocenter{}, err
+		}
+		return geoFindGeocenter(o)
+	}
+	gc1, err := geocenter()
+	if err != nil {
+		return err
+	}
+	err = o.compactResults()
+	if err != nil {
+		return err
+	}
+	if len(o.Results) != 4 {
+		return fmt.Errorf("results were not compacted")
+	}
+	gc2, err := geocenter()
+	if err != nil {
+		return err
+	}
+	if gc1.Weight != gc2.Weight || math.Abs(gc1.Latitude-gc2.Latitude) > 0.0001 ||
+		math.Abs(gc1.Longitude-gc2.Longitude) > 0.0001 {
+		return fmt.Errorf("geocenter changed after compaction")
+	}
+
+	// Events represented by a compacted result expire individually
+	o = object{}
+	add("d", 37.3845, -122.0881, 680*time.Hour, 3)
+	add("d", 37.3845, -122.0881, 10*time.Hour, 2)
+	add("d", 37.3845, -122.0881, 0, 1)
+	err = o.compactResults()
+	if err != nil {
+		return err
+	}
+	if len(o.Results) != 2 || o.Results[0].Count != 5 {
+		return fmt.Errorf("results were not compacted")
+	}
+	cfg.Timer.ExpireEvents = "650h"
+	err = o.pruneExpiredEvents()
+	cfg.Timer.ExpireEvents = "720h"
+	if err != nil {
+		return err
+	}
+	if len(o.Results) != 2 || o.Results[0].Count != 2 {
+		return fmt.Errorf("expired events were not removed from compacted result")
+	}
+	if o.Results[0].firstSeen().Before(now.Add(-35 * time.Hour)) {
+		return fmt.Errorf("first seen time not updated for expired events")
+	}
+	_, err = geocenter()
+	if err != nil {
+		return err
+	}
+	if o.Results[0].Weight != 3 {
+		return fmt.Errorf("expired events included in weight")
 	}
 	return nil
 }
 
-func testtab2Func() error {
+func testtab27Func() error {
 	s := getStateService().(*simpleStateService).getStore()
 	if len(s) != 1 {
 		return fmt.Errorf("more than one entry in state")
 	}
 	for _, v := range s {
-		if v.WeightDeviation == 0 {
-			return fmt.Errorf("weight threshold was 0")
+		if len(v.Results) != 3 {
+			return fmt.Errorf("incorrect number of results")
 		}
-		if v.NumCenters != 2 {
-			return fmt.Errorf("incorrect number of geocenters")
+		if v.EventCount != 12 || v.NumCenters != 1 {
+			return fmt.Errorf("incorrect event count or geocenters")
 		}
-		collapseCnt := 0
 		for _, x := range v.Results {
-			if x.Collapsed {
-				collapseCnt++
+			if x.Count == 0 {
+				continue
 			}
-		}
-		if collapseCnt != 19 {
-			return fmt.Errorf("incorrect number of collapsed results")
-		}
-		for _, x := range v.Results {
-			if !x.Escalated {
-				return fmt.Errorf("a result entry was not escalated")
+			if x.Count != 10 || !x.firstSeen().Before(x.Timestamp) {
+				return fmt.Errorf("incorrect compacted result")
 			}
 		}
+		if v.Geocenter.Weight != 12+11 {
+			return fmt.Errorf("incorrect geocenter weight")
+		}
 	}
 	return nil
 }
 
-func testtab3Func() error {
+func testtab28Func() error {
 	s := getStateService().(*simpleStateService).getStore()
 	if len(s) != 1 {
 		return fmt.Errorf("more than one entry in state")
 	}
 	for _, v := range s {
-		if v.WeightDeviation != 0 {
-			return fmt.Errorf("weight threshold was not 0")
+		if len(v.Geocenters) != 3 {
+			return fmt.Errorf("incorrect number of primary geocenters")
 		}
-		if v.NumCenters != 2 {
-			return fmt.Errorf("incorrect number of geocenters")
+		if v.Geocenters[0].Weight != 6 || v.Geocenters[1].Weight != 3 ||
+			v.Geocenters[2].Weight != 1 {
+			return fmt.Errorf("primary geocenters ranked incorrectly")
+		}
+		if v.Geocenters[0].Locality.City != "Mountain View" ||
+			math.Abs(v.Geocenters[0].Latitude-37.3845) > 0.0001 ||
+			math.Abs(v.Geocenters[0].Longitude+122.0881) > 0.0001 {
+			return fmt.Errorf("incorrect primary geocenter")
 		}
-		collapseCnt := 0
 		for _, x := range v.Results {
-			if x.Collapsed {
-				collapseCnt++
+			if x.SourceIPV4 != "207.126.102.7" {
+				continue
+			}
+			ad, err := v.createAlertDetailsBranch(x.BranchID)
+			if err != nil {
+				return err
+			}
+			if ad.GeocenterLocality.City != "Mountain View" ||
+				ad.GeocenterDistance < 1000 || ad.GeocenterDistance > 2000 {
+				return fmt.Errorf("alert did not use nearest geocenter")
 			}
 		}
-		if collapseCnt != 28 {
-			return fmt.Errorf("incorrect number of collapsed results")
+
+		cfg.Geo.PrimaryGeocenters = 1
+		gcs, err := geoFindGeocenters(v)
+		if err != nil {
+			return err
 		}
-		for _, x := range v.Results {
-			if !x.Escalated {
-				return fmt.Errorf("a result entry was not escalated")
-			}
+		if len(gcs) != 1 {
+			return fmt.Errorf("incorrect number of primary geocenters")
 		}
 	}
+
+	// A locality spanning the dateline should have its geocenter on the
+	// dateline
+	var o object
+	o.Results = []objectResult{
+		{BranchID: "a", Latitude: 10, Longitude: 179.5},
+		{BranchID: "b", Latitude: 10, Longitude: -179.5, Collapsed: true,
+			CollapseBranch: "a"},
+	}
+	gcs, err := geoFindGeocenters(o)
+	if err != nil {
+		return err
+	}
+	if len(gcs) != 1 || math.Abs(math.Abs(gcs[0].Longitude)-180) > 0.0001 ||
+		gcs[0].AvgDist > 60 {
+		return fmt.Errorf("incorrect geocenter across the dateline")
+	}
 	return nil
 }
 
-func testtab4FuncPre() error {
+func testtab29Func() error {
 	s := getStateService().(*simpleStateService).getStore()
 	if len(s) != 1 {
 		return fmt.Errorf("more than one entry in state")
 	}
 	for _, v := range s {
-		if v.WeightDeviation != 0 {
-			return fmt.Errorf("weight threshold was not 0")
-		}
-		if v.NumCenters != 1 {
-			return fmt.Errorf("incorrect number of geocenters")
-		}
-		collapseCnt := 0
-		for _, x := range v.Results {
-			if x.Collapsed {
-				collapseCnt++
-			}
+		if v.Profile.total() != 5 || v.usualLocation().String() != "America/Los_Angeles" {
+			return fmt.Errorf("incorrect login time profile")
 		}
-		if collapseCnt != 14 {
-			return fmt.Errorf("incorrect number of collapsed results")
+	}
+
+	cfg.Geo.UnusualTime = true
+	loc, err := time.LoadLocation("America/Los_Angeles")
+	if err != nil {
+		return err
+	}
+	var o object
+	o.Geocenters = []objectGeocenter{{Locality: Locality{TimeZone: "America/Los_Angeles"}}}
+	// Business hours on weekdays
+	for d := 1; d <= 5; d++ {
+		for h := 9; h <= 17; h++ {
+			o.Profile.add(time.Date(2017, 1, d+1, h, 0, 0, 0, loc))
 		}
+	}
+	severity := func(t time.Time) (alertDetailsBranch, error) {
+		ad := alertDetailsBranch{Timestamp: t}
+		ad.addProfile(&o)
+		err := ad.calculateSeverity()
+		return ad, err
+	}
+	ad, err := severity(time.Date(2017, 1, 8, 3, 0, 0, 0, loc))
+	if err != nil {
+		return err
+	}
+	if !ad.UnusualHour || !ad.UnusualDay || ad.Severity != 3 {
+		return fmt.Errorf("login at unusual time was not detected")
+	}
+	if ad.LocalTime != "Sun 03:00 PST" {
+		return fmt.Errorf("incorrect local time %v", ad.LocalTime)
+	}
+	ad, err = severity(time.Date(2017, 1, 10, 10, 0, 0, 0, loc).UTC())
+	if err != nil {
+		return err
+	}
+	if ad.UnusualHour || ad.UnusualDay || ad.Severity != 1 {
+		return fmt.Errorf("login in business hours was unusual")
+	}
+
+	// If the usual timezone changes, the events recorded in the previous
+	// timezone are compared at the same absolute time
+	o.Geocenters[0].Locality.TimeZone = "Asia/Taipei"
+	ad, err = severity(time.Date(2017, 1, 10, 10, 0, 0, 0, loc))
+	if err != nil {
+		return err
+	}
+	if ad.UnusualHour || ad.UnusualDay || ad.LocalTime != "Wed 02:00 CST" {
+		return fmt.Errorf("profile was not converted to usual timezone")
+	}
+	ad, err = severity(time.Date(2017, 1, 8, 3, 0, 0, 0, loc))
+	if err != nil {
+		return err
+	}
+	if !ad.UnusualHour || !ad.UnusualDay {
+		return fmt.Errorf("login at unusual time was not detected")
+	}
+
+	// Profiles recorded in the usual timezone by older versions are
+	// rebuilt from the stored results
+	o.Profile = objectProfile{OldHours: make([]int, 24)}
+	o.Results = []objectResult{{Timestamp: time.Date(2017, 1, 8, 3, 0, 0, 0, loc), Count: 3}}
+	err = o.upgradeState()
+	if err != nil {
+		return err
+	}
+	if o.Profile.total() != 3 || len(o.Profile.OldHours) != 0 {
+		return fmt.Errorf("older login time profile was not rebuilt")
+	}
+	return nil
+}
+
+func testtab30FuncPre() error {
+	cfg.Geo.SharedIPThreshold = 3
+	_, subnet, err := net.ParseCIDR("207.126.102.0/24")
+	if err != nil {
+		return err
+	}
+	cfg.sharedEgress = []*net.IPNet{subnet}
+	return nil
+}
+
+func testtab30Func() error {
+	s := getStateService().(*simpleStateService).getStore()
+	if len(s) != 3 {
+		return fmt.Errorf("incorrect number of entries in state")
+	}
+	if len(sharedIPs.alerted) != 1 {
+		return fmt.Errorf("incorrect number of shared source addresses")
+	}
+	if _, ok := sharedIPs.alerted["63.245.214.133"]; !ok {
+		return fmt.Errorf("shared source address was not detected")
+	}
+
+	// Another principal using the address within the window should not
+	// alert again, but a third principal using a second address should
+	now := time.Now().UTC()
+	ads, err := sharedIPs.update([]eventResult{
+		{Principal: "user4@host.com", SourceIPV4: "63.245.214.133",
+			Timestamp: now, Valid: true},
+		{Principal: "user3@host.com", SourceIPV4: "118.163.10.187",
+			Timestamp: now, Valid: true},
+	}, now)
+	if err != nil {
+		return err
+	}
+	if len(ads) != 1 || ads[0].SourceIPV4 != "118.163.10.187" {
+		return fmt.Errorf("incorrect shared source address alerts")
+	}
+	if strings.Join(ads[0].Principals, ",") != "user1@host.com,user2@host.com,user3@host.com" {
+		return fmt.Errorf("incorrect principals in shared source address alert")
+	}
+	summary, err := ads[0].makeSummary()
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(summary, "118.163.10.187 SHAREDIP used by 3 principals") {
+		return fmt.Errorf("incorrect summary %v", summary)
+	}
+
+	// An event with a future timestamp is treated as occurring at the merge
+	// time, and does not remove the other principals from the index
+	ads, err = sharedIPs.update([]eventResult{
+		{Principal: "user6@host.com", SourceIPV4: "63.245.214.133",
+			Timestamp: now.Add(24 * time.Hour), Valid: true},
+	}, now)
+	if err != nil {
+		return err
+	}
+	if len(ads) != 0 || len(sharedIPs.entries["118.163.10.187"]) != 3 ||
+		!sharedIPs.entries["63.245.214.133"]["user6@host.com"].Equal(now) {
+		return fmt.Errorf("future event expired shared source address index")
+	}
+
+	// Principals outside the window are removed from the index
+	ads, err = sharedIPs.update([]eventResult{
+		{Principal: "user5@host.com", SourceIPV4: "63.245.214.133",
+			Timestamp: now.Add(2 * time.Hour), Valid: true},
+	}, now.Add(2*time.Hour))
+	if err != nil {
+		return err
+	}
+	if len(ads) != 0 || len(sharedIPs.entries["63.245.214.133"]) != 1 {
+		return fmt.Errorf("shared source address index was not pruned")
+	}
+	return nil
+}
+
+func testtab31FuncPre() error {
+	cfg.Geo.StormThreshold = 3
+	return nil
+}
+
+func testtab31Func() error {
+	s := getStateService().(*simpleStateService).getStore()
+	if len(s) != 4 {
+		return fmt.Errorf("incorrect number of entries in state")
+	}
+	for _, v := range s {
 		for _, x := range v.Results {
 			if !x.Escalated {
-				return fmt.Errorf("a result entry was not escalated")
-			}
-		}
-		// Locate the branch entry last created and validate alert
-		// generation
-		testStr := "user@host.com NEWLOCATION Mountain View, United States "
-		testStr += "access from 63.245.214.133 (test) [deviation:0],"
-		testStr += " no previous locations stored in window"
-		var o objectResult
-		for _, x := range v.Results {
-			if x.Collapsed {
-				continue
+				return fmt.Errorf("new geocenter was not escalated")
 			}
-			if x.SourceIPV4 != "63.245.214.133" {
-				continue
+			// Without an ASN database the network is unknown, so the
+			// new geocenters can not be correlated
+			if stormEligible(x) {
+				return fmt.Errorf("new geocenter without asn was eligible")
 			}
-			o = x
-			break
-		}
-		ad, err := v.createAlertDetailsBranch(o.BranchID)
-		if err != nil {
-			return err
-		}
-		err = ad.addPreviousEvent(&v, o.BranchID)
-		if err != nil {
-			return err
-		}
-		err = ad.calculateSeverity()
-		if err != nil {
-			return err
-		}
-		// This is a new alert with no previous country details, so we should have
-		// a severity of 1
-		if ad.Severity != 1 {
-			return fmt.Errorf("alert had incorrect severity")
-		}
-		if ad.Category != "NEWLOCATION" {
-			return fmt.Errorf("alert had incorrect category")
-		}
-		sumstr, err := ad.makeSummary()
-		if err != nil {
-			return err
-		}
-		if sumstr != testStr {
-			return fmt.Errorf("alert summary did not match")
 		}
 	}
+	if len(storms.pending) != 0 || len(storms.shifts) != 0 {
+		return fmt.Errorf("new geocenters without asn were held")
+	}
+
+	// Held alerts are released once the grace period has passed
+	now := time.Now().UTC()
+	tp := Locality{City: "Taipei", Country: "Taiwan"}
+	hold := func(p string, l Locality, t time.Time, sev int) {
+		storms.hold(stormCandidate{principal: p, locality: l, asn: 64496,
+			asnOrg: "Example", timestamp: t, held: t,
+			alert: &alertDetailsBranch{Severity: sev}})
+	}
+	hold("user5@host.com", tp, now, 1)
+	shifts, release, err := storms.flush(now)
+	if err != nil {
+		return err
+	}
+	if len(shifts) != 0 || len(release) != 0 || len(storms.pending) != 1 {
+		return fmt.Errorf("alert was not held for grace period")
+	}
+	shifts, release, err = storms.flush(now.Add(6 * time.Minute))
+	if err != nil {
+		return err
+	}
+	if len(shifts) != 0 || len(release) != 1 || len(storms.pending) != 0 {
+		return fmt.Errorf("alert was not released after grace period")
+	}
+
+	// Principals are correlated across merge cycles within the window, and
+	// a new shift reports every principal using the highest severity
+	hold("user6@host.com", tp, now.Add(10*time.Minute), 2)
+	shifts, release, err = storms.flush(now.Add(10 * time.Minute))
+	if err != nil {
+		return err
+	}
+	if len(shifts) != 0 || len(release) != 0 {
+		return fmt.Errorf("location shift detected below threshold")
+	}
+	hold("user7@host.com", tp, now.Add(11*time.Minute), 2)
+	shifts, release, err = storms.flush(now.Add(11 * time.Minute))
+	if err != nil {
+		return err
+	}
+	if len(shifts) != 1 || len(release) != 0 || shifts[0].Severity != 2 ||
+		len(shifts[0].Principals) != 3 || len(storms.pending) != 0 {
+		return fmt.Errorf("location shift was not detected")
+	}
+	summary, err := shifts[0].makeSummary()
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(summary, "LOCATIONSHIFT Taipei, Taiwan new location for 3 principals [AS64496 Example]") {
+		return fmt.Errorf("incorrect summary %v", summary)
+	}
+
+	// New geocenters in the locality of an active shift are suppressed,
+	// others are released to be sent individually
+	hold("user8@host.com", tp, now.Add(12*time.Minute), 1)
+	hold("user8@host.com", Locality{City: "Tokyo", Country: "Japan"},
+		now.Add(12*time.Minute), 1)
+	shifts, release, err = storms.flush(now.Add(18 * time.Minute))
+	if err != nil {
+		return err
+	}
+	if len(shifts) != 0 || len(release) != 1 {
+		return fmt.Errorf("incorrect location shift correlation")
+	}
+
+	// The shift ends once no principals have been seen for the window
+	_, _, err = storms.flush(now.Add(2 * time.Hour))
+	if err != nil {
+		return err
+	}
+	if len(storms.shifts) != 0 || len(storms.seen) != 0 {
+		return fmt.Errorf("location shift did not expire")
+	}
+
+	// When the merge process stops, held alerts are taken within the
+	// grace period so they can be sent
+	hold("user9@host.com", tp, now.Add(3*time.Hour), 1)
+	storms.hold(stormCandidate{principal: "user10@host.com", locality: tp,
+		asn: 64496, timestamp: now.Add(3 * time.Hour)})
+	release = storms.takePending()
+	if len(release) != 1 || len(storms.pending) != 0 {
+		return fmt.Errorf("held alerts were not taken")
+	}
 	return nil
 }
 
-func testtab4FuncPost() error {
+func testtab32FuncPre() error {
+	now := time.Now().UTC()
+	travelNotices.add(travelNotice{
+		Principal:    "user@host.com",
+		Destinations: []string{"JP", "Taipei/TW"},
+		Start:        now.Add(-24 * time.Hour),
+		End:          now.Add(24 * time.Hour),
+	})
+	return nil
+}
+
+func testtab32Func() error {
 	s := getStateService().(*simpleStateService).getStore()
 	if len(s) != 1 {
 		return fmt.Errorf("more than one entry in state")
 	}
 	for _, v := range s {
-		if v.WeightDeviation == 0 {
-			return fmt.Errorf("weight threshold was 0")
-		}
-		if v.NumCenters != 2 {
-			return fmt.Errorf("incorrect number of geocenters")
-		}
-		collapseCnt := 0
-		for _, x := range v.Results {
-			if x.Collapsed {
-				collapseCnt++
-			}
-		}
-		if collapseCnt != 33 {
-			return fmt.Errorf("incorrect number of collapsed results")
-		}
+		var tw, mv objectResult
 		for _, x := range v.Results {
-			if !x.Escalated {
-				return fmt.Errorf("a result entry was not escalated")
+			if x.Locality.CountryCode == "TW" {
+				tw = x
+			} else {
+				mv = x
 			}
 		}
-
-		// Locate the branch entry last created and validate alert
-		// generation
-		testStr := "user@host.com NEWCOUNTRY Taipei, Taiwan access from "
-		testStr += "118.163.10.187 (test) [deviation:12.5]"
-		testStr += " last activity was from Mountain View, United States "
-		testStr += "(10423 km away) within hour before"
-		var o objectResult
-		for _, x := range v.Results {
-			if x.Collapsed {
-				continue
-			}
-			if x.SourceIPV4 != "118.163.10.187" {
-				continue
-			}
-			o = x
-			break
+		ad, err := v.branchAlert(tw.BranchID, false)
+		if err != nil {
+			return err
 		}
-		ad, err := v.createAlertDetailsBranch(o.BranchID)
+		if ad.TravelNotice != 1 || ad.Severity != 0 {
+			return fmt.Errorf("branch alert was not downgraded by travel notice")
+		}
+		cfg.Geo.TravelMode = travelAnnotate
+		ad, err = v.branchAlert(tw.BranchID, false)
 		if err != nil {
 			return err
 		}
-		err = ad.addPreviousEvent(&v, o.BranchID)
+		if ad.TravelNotice != 1 || ad.Severity == 0 {
+			return fmt.Errorf("branch alert was not annotated with travel notice")
+		}
+		summary, err := ad.makeSummary()
 		if err != nil {
 			return err
 		}
-		err = ad.calculateSeverity()
+		if !strings.Contains(summary, "[travel notice 1]") {
+			return fmt.Errorf("incorrect summary %v", summary)
+		}
+		// The movement is covered if the other locality was known before
+		// the merge
+		cfg.Geo.TravelMode = ""
+		v.newBranches = map[string]bool{tw.BranchID: true}
+		md := alertDetailsMovement{Principal: v.ObjectIDString,
+			Localities: []objectResult{mv, tw}}
+		md.calculateSeverity()
+		md.addTravel(&v)
+		if md.TravelNotice != 1 || md.Severity != 0 {
+			return fmt.Errorf("movement alert was not downgraded by travel notice")
+		}
+		v.newBranches[mv.BranchID] = true
+		md.TravelNotice = 0
+		md.calculateSeverity()
+		md.addTravel(&v)
+		if md.TravelNotice != 0 || md.Severity != 3 {
+			return fmt.Errorf("movement alert with unknown locality was downgraded")
+		}
+	}
+
+	tn, err := parseTravelNotice([]string{"user@host.com", "2017-01-01",
+		"2017-01-02", "FR", " Paris/fr"})
+	if err != nil {
+		return err
+	}
+	paris := Locality{City: "Paris", Country: "France", CountryCode: "FR"}
+	if !tn.covers(paris, time.Date(2017, 1, 2, 23, 0, 0, 0, time.UTC)) ||
+		tn.covers(paris, time.Date(2017, 1, 3, 0, 0, 0, 0, time.UTC)) {
+		return fmt.Errorf("incorrect travel notice date range")
+	}
+	_, err = parseTravelNotice([]string{"user@host.com", "2017-01-01",
+		"2017-01-02", "France"})
+	if err == nil {
+		return fmt.Errorf("travel notice with invalid destination was accepted")
+	}
+	_, err = parseTravelNotice([]string{"user@host.com", "2017-01-02",
+		"2016-12-31", "FR"})
+	if err == nil {
+		return fmt.Errorf("travel notice ending before start was accepted")
+	}
+	return nil
+}
+
+func testtab33FuncFeedback() error {
+	s := getStateService().(*simpleStateService).getStore()
+	if len(s) != 1 {
+		return fmt.Errorf("more than one entry in state")
+	}
+	for _, v := range s {
+		if len(v.Results) != 2 {
+			return fmt.Errorf("incorrect number of results")
+		}
+		// The alert for the locality in the United States is confirmed,
+		// and the alert for the locality in Taiwan is a false positive
+		ids := make([]string, 2)
+		for _, x := range v.Results {
+			ad, err := v.branchAlert(x.BranchID, false)
+			if err != nil {
+				return err
+			}
+			if ad.AlertID == "" || ad.BranchID != x.BranchID {
+				return fmt.Errorf("alert has no identifiers")
+			}
+			if x.Locality.CountryCode == "US" {
+				ids[0] = ad.AlertID
+			} else {
+				ids[1] = ad.AlertID
+			}
+		}
+		err := getStateService().writeObject(v)
 		if err != nil {
 			return err
 		}
-		// A new country is present, so we should have a severity of 2
-		if ad.Severity != 2 {
-			return fmt.Errorf("alert had incorrect severity")
+		err = queueFeedback(feedbackRequest{Principal: v.ObjectIDString,
+			AlertID: ids[0], Verdict: "unsure"})
+		if err == nil {
+			return fmt.Errorf("feedback with invalid verdict was accepted")
 		}
-		if ad.Category != "NEWCOUNTRY" {
-			return fmt.Errorf("alert had incorrect category")
+		for i, verdict := range []string{feedbackConfirmed, feedbackFalsePositive} {
+			err = queueFeedback(feedbackRequest{Principal: v.ObjectIDString,
+				AlertID: ids[i], Verdict: verdict})
+			if err != nil {
+				return err
+			}
 		}
-		sumstr, err := ad.makeSummary()
+		// A later verdict for an alert replaces the earlier one
+		err = queueFeedback(feedbackRequest{Principal: v.ObjectIDString,
+			AlertID: ids[0], Verdict: feedbackFalsePositive})
 		if err != nil {
 			return err
 		}
-		if sumstr != testStr {
-			return fmt.Errorf("alert summary did not match")
+		err = queueFeedback(feedbackRequest{Principal: v.ObjectIDString,
+			AlertID: ids[0], Verdict: feedbackConfirmed})
+		if err != nil {
+			return err
 		}
 	}
+	// Feedback is applied by the next merge, and approved and hostile
+	// localities are kept once the events have expired
+	cfg.Timer.ExpireEvents = "1h"
 	return nil
 }
 
-func testtab5FuncPre() error {
+func testtab33Func() error {
 	s := getStateService().(*simpleStateService).getStore()
 	if len(s) != 1 {
 		return fmt.Errorf("more than one entry in state")
 	}
 	for _, v := range s {
-		if len(v.Results) != 10 {
-			return fmt.Errorf("incorrect number of stored results in pre func")
+		if len(v.Results) != 1 || len(v.Alerts) != 0 {
+			return fmt.Errorf("expired results or alerts were not pruned")
+		}
+		if len(v.Approved) != 1 || len(v.Hostile) != 1 ||
+			v.Approved[0].Locality.CountryCode != "TW" ||
+			v.Hostile[0].Locality.CountryCode != "US" {
+			return fmt.Errorf("incorrect analyst feedback")
+		}
+		err := v.addEventResult(eventResult{Principal: v.ObjectIDString,
+			SourceIPV4: "118.163.10.187", Timestamp: time.Now().UTC(),
+			Valid: true, Name: "test"})
+		if err != nil {
+			return err
+		}
+		err = v.addEventResult(eventResult{Principal: v.ObjectIDString,
+			SourceIPV4: "63.245.214.133", Timestamp: time.Now().UTC(),
+			Valid: true, Name: "test"})
+		if err != nil {
+			return err
+		}
+		if !v.Results[1].Escalated {
+			return fmt.Errorf("login from approved locality was not known")
+		}
+		if len(v.hostileResults) != 1 || v.hostileResults[0].SourceIPV4 != "63.245.214.133" {
+			return fmt.Errorf("login from hostile locality was not identified")
+		}
+		var ad alertDetailsBranch
+		ad.fromResult(&v, v.hostileResults[0])
+		ad.Category = "HOSTILELOCATION"
+		summary, err := ad.makeSummary()
+		if err != nil {
+			return err
+		}
+		if !strings.HasSuffix(summary, ", locality confirmed hostile by analyst") {
+			return fmt.Errorf("incorrect summary %v", summary)
 		}
 	}
 	return nil
 }
 
-func testtab5FuncPost() error {
+func testtab33FuncStandalone() error {
 	s := getStateService().(*simpleStateService).getStore()
-	if len(s) != 1 {
-		return fmt.Errorf("more than one entry in state")
-	}
 	for _, v := range s {
-		if len(v.Results) != 20 {
-			return fmt.Errorf("incorrect number of stored results in post func")
+		ad, err := v.branchAlert(v.Results[0].BranchID, false)
+		if err != nil {
+			return err
 		}
-		if v.NumCenters != 1 {
-			return fmt.Errorf("incorrect number of geocenters")
+		err = getStateService().writeObject(v)
+		if err != nil {
+			return err
+		}
+		// The principal has no events in the next merge, so the feedback
+		// is applied to the stored state directly
+		err = queueFeedback(feedbackRequest{Principal: v.ObjectIDString,
+			AlertID: ad.AlertID, Verdict: feedbackFalsePositive})
+		if err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
-func testtab6FuncEntry1() error {
+func testtab33FuncStandaloneCheck() error {
 	s := getStateService().(*simpleStateService).getStore()
 	if len(s) != 2 {
 		return fmt.Errorf("incorrect number of entries in state")
 	}
-	oid, err := getObjectID("user@host.com")
+	for _, v := range s {
+		if v.ObjectIDString != "user@host.com" {
+			continue
+		}
+		if len(v.Approved) != 2 || len(v.Hostile) != 1 {
+			return fmt.Errorf("feedback for principal without events not applied")
+		}
+		return nil
+	}
+	return fmt.Errorf("principal not found")
+}
+
+func testtab34Func() error {
+	fd, err := ioutil.TempFile("", "geomodel")
 	if err != nil {
 		return err
 	}
-	uhent := s[oid]
-	oid, err = getObjectID("login@host.org")
+	defer os.Remove(fd.Name())
+	fmt.Fprintf(fd, "# Name,Token\n")
+	fmt.Fprintf(fd, "console,0123456789abcdef\n")
+	fd.Close()
+	cfg.apiTokens, err = readAPITokens(fd.Name())
 	if err != nil {
 		return err
 	}
-	lhent := s[oid]
-	if len(uhent.Results) != 42 {
-		return fmt.Errorf("incorrect number of events for user@host.com in entry1")
-	}
-	if uhent.NumCenters != 2 {
-		return fmt.Errorf("incorrect number of geocenters for user@host.com in entry1")
+	_, err = parseAPIToken([]string{"console", "short"})
+	if err == nil {
+		return fmt.Errorf("short api token was accepted")
 	}
-	if len(lhent.Results) != 40 {
-		return fmt.Errorf("incorrect number of events for login@host.org in entry1")
+
+	handled := 0
+	h := apiAuth(func(w http.ResponseWriter, r *http.Request) {
+		handled++
+	})
+	for _, tok := range []string{"", "Bearer 0123456789abcdee", "0123456789abcdef"} {
+		r := httptest.NewRequest("GET", "/travel", nil)
+		if tok != "" {
+			r.Header.Set("Authorization", tok)
+		}
+		w := httptest.NewRecorder()
+		h(w, r)
+		if w.Code != http.StatusUnauthorized {
+			return fmt.Errorf("request with invalid token was not rejected")
+		}
 	}
-	if lhent.NumCenters != 1 {
-		return fmt.Errorf("incorrect number of geocenters for login@host.org in entry1")
+	r := httptest.NewRequest("GET", "/travel", nil)
+	r.Header.Set("Authorization", "Bearer 0123456789abcdef")
+	h(httptest.NewRecorder(), r)
+	if handled != 1 {
+		return fmt.Errorf("request with valid token was not handled")
 	}
-
-	// Change the stored expiry duration value, which will result in some
-	// of the events entered in the previous phase being removed
-	cfg.Timer.ExpireEvents = "250h"
 	return nil
 }
 
-func testtab6FuncFinal() error {
-	s := getStateService().(*simpleStateService).getStore()
-	if len(s) != 2 {
-		return fmt.Errorf("incorrect number of entries in state")
-	}
-	oid, err := getObjectID("user@host.com")
-	if err != nil {
-		return err
-	}
-	uhent := s[oid]
-	oid, err = getObjectID("login@host.org")
+func testtab35FuncPre() error {
+	epoch := maxmindEpoch()
+	cfg.General.MaxMindASN = os.Getenv("TESTASNMMF")
+	err := maxmindInit()
 	if err != nil {
 		return err
 	}
-	lhent := s[oid]
-	if len(uhent.Results) != 55 {
-		return fmt.Errorf("incorrect number of events for user@host.com in final")
-	}
-	if len(lhent.Results) != 40 {
-		return fmt.Errorf("incorrect number of events for login@host.org in final")
+	// Adding a database changes the epoch so stored results are
+	// re-geolocated
+	if maxmindEpoch() == epoch {
+		return fmt.Errorf("maxmind epoch did not include asn database")
 	}
 	return nil
 }
 
-func testtab7Func() error {
+func testtab35Func() error {
 	s := getStateService().(*simpleStateService).getStore()
 	if len(s) != 1 {
 		return fmt.Errorf("more than one entry in state")
 	}
 	for _, v := range s {
-		if v.WeightDeviation == 0 {
-			return fmt.Errorf("weight threshold was 0")
-		}
-		if v.NumCenters != 2 {
-			return fmt.Errorf("incorrect number of geocenters")
+		known := v.Results[0]
+		if known.ASN == 0 || known.ASNOrg == "" {
+			return fmt.Errorf("result did not include asn")
 		}
-		collapseCnt := 0
-		for _, x := range v.Results {
-			if x.Collapsed {
-				collapseCnt++
-			}
+		add := func(ip string) error {
+			return v.addEventResult(eventResult{Principal: v.ObjectIDString,
+				SourceIPV4: ip, Timestamp: time.Now().UTC(), Valid: true,
+				Name: "test"})
 		}
-		if collapseCnt != 18 {
-			return fmt.Errorf("incorrect number of collapsed results")
+
+		// A login from a network already seen in the locality is known
+		err := add("63.245.214.133")
+		if err != nil {
+			return err
 		}
-		for _, x := range v.Results {
-			if !x.Escalated {
-				return fmt.Errorf("a result entry was not escalated")
-			}
+		if len(v.newASNResults) != 0 {
+			return fmt.Errorf("known asn was treated as new")
 		}
 
-		// Locate the branch entry last created and validate alert
-		// generation
-		testStr := "user@host.com NEWLOCATION Louisville, United States access from "
-		testStr += "207.126.102.129 (test) [deviation:5]"
-		testStr += " last activity was from Mountain View, United States "
-		testStr += "(1490 km away) within hour before"
-		var o objectResult
-		for _, x := range v.Results {
-			if x.Collapsed {
-				continue
+		// Place an address from another network in the known locality
+		newip := ""
+		for _, x := range []string{"63.245.214.10", "118.163.10.187"} {
+			var res objectResult
+			err = geoASNObjectResult(&res, net.ParseIP(x))
+			if err != nil {
+				return err
 			}
-			if x.SourceIPV4 != "207.126.102.129" {
-				continue
+			if res.ASN != 0 && res.ASN != known.ASN {
+				newip = x
+				break
 			}
-			o = x
-			break
 		}
-		ad, err := v.createAlertDetailsBranch(o.BranchID)
-		if err != nil {
-			return err
+		if newip == "" {
+			return fmt.Errorf("no address from another network in asn database")
 		}
-		err = ad.addPreviousEvent(&v, o.BranchID)
+		ovr, err := parseOverride([]string{newip + "/32", "Mountain View",
+			"United States", fmt.Sprint(known.Latitude), fmt.Sprint(known.Longitude)})
 		if err != nil {
 			return err
 		}
-		err = ad.calculateSeverity()
+		cfg.overrides = []override{ovr}
+		err = add(newip)
 		if err != nil {
 			return err
 		}
-		// This was a locality change in the same country, we should have
-		// a severity of 1
-		if ad.Severity != 1 {
-			return fmt.Errorf("alert had incorrect severity")
+		if len(v.newASNResults) != 1 || v.newASNResults[0].ASN == known.ASN {
+			return fmt.Errorf("new asn in known locality was not identified")
 		}
-		sumstr, err := ad.makeSummary()
+		var ad alertDetailsBranch
+		ad.fromResult(&v, v.newASNResults[0])
+		ad.Category = "NEWASN"
+		summary, err := ad.makeSummary()
 		if err != nil {
 			return err
 		}
-		if sumstr != testStr {
-			return fmt.Errorf("alert summary did not match")
+		if !strings.HasSuffix(summary, ", network not previously seen within known locality") {
+			return fmt.Errorf("incorrect summary %v", summary)
 		}
-	}
-	return nil
-}
 
-func testtab8Func() error {
-	s := getStateService().(*simpleStateService).getStore()
-	if len(s) != 1 {
-		return fmt.Errorf("more than one entry in state")
-	}
-	for _, v := range s {
-		alert, err := v.analyzeUsageWithinWindow()
+		// Only the first login from the new network is reported
+		err = add(newip)
 		if err != nil {
 			return err
 		}
-		if len(alert) == 0 {
-			return fmt.Errorf("analyzeUsageWithinWindow did not return results")
+		if len(v.newASNResults) != 1 {
+			return fmt.Errorf("new asn was reported more than once")
 		}
-		ad, err := v.createAlertDetailsMovement(alert)
-		if err != nil {
-			return err
+
+		// Results stored before the asn database was configured leave the
+		// networks used in the locality unknown
+		var nr []objectResult
+		for _, x := range v.Results {
+			if x.ASN != known.ASN {
+				continue
+			}
+			x.ASN = 0
+			x.ASNOrg = ""
+			nr = append(nr, x)
 		}
-		sumstr, err := ad.makeSummary()
+		v.Results = nr
+		v.newASNResults = nil
+		err = add(newip)
 		if err != nil {
 			return err
 		}
-		testStr := "user@host.com MOVEMENT window violation "
-		testStr += "(Taipei, Taiwan) -> (Mountain View, United States) "
-		testStr += "within 4h window"
-		if sumstr != testStr {
-			return fmt.Errorf("alert summary did not match")
+		if len(v.newASNResults) != 0 {
+			return fmt.Errorf("asn in locality without asn data was treated as new")
 		}
 	}
 	return nil
 }
 
-func testtab9Func() error {
+func testtab36FuncPre() error {
+	cfg.Geo.HistoryRetention = "8760h"
+	cfg.exclusions = []exclusion{
+		{mustParseCIDR("118.163.10.0/24"), "scanner", exclusionNoAlert},
+	}
+	return nil
+}
+
+func testtab36Func() error {
 	s := getStateService().(*simpleStateService).getStore()
 	if len(s) != 1 {
 		return fmt.Errorf("more than one entry in state")
 	}
 	for _, v := range s {
-		// We should only have a single geocenter in the model since the unknown
-		// entry will have been discarded
-		if v.NumCenters != 1 {
-			return fmt.Errorf("incorrect number of geocenters")
+		if len(v.Results) != 2 {
+			return fmt.Errorf("incorrect number of results")
+		}
+		// Only the alerting login from Taipei is in the history summary,
+		// the expired noalert results never made the locality known
+		if len(v.History.Localities) != 2 {
+			return fmt.Errorf("incorrect history summary")
+		}
+		for _, x := range v.History.Localities {
+			if x.Locality.City == "Taipei" && x.Count != 1 {
+				return fmt.Errorf("noalert result was added to history summary")
+			}
+		}
+		if v.Profile.total() != 2 {
+			return fmt.Errorf("noalert result was added to profile")
 		}
 	}
 	return nil
@@ -885,3 +3576,114 @@ func TestAnalyzeTab8(t *testing.T) {
 func TestAnalyzeTab9(t *testing.T) {
 	runTestTable(testtab9, t)
 }
+
+func TestAnalyzeTab10(t *testing.T) {
+	runTestTable(testtab10, t)
+}
+
+func TestAnalyzeTab11(t *testing.T) {
+	runTestTable(testtab11, t)
+}
+
+func TestAnalyzeTab12(t *testing.T) {
+	runTestTable(testtab12, t)
+}
+
+func TestAnalyzeTab13(t *testing.T) {
+	runTestTable(testtab13, t)
+}
+
+func TestAnalyzeTab14(t *testing.T) {
+	runTestTable(testtab14, t)
+}
+
+func TestAnalyzeTab15(t *testing.T) {
+	runTestTable(testtab15, t)
+}
+
+func TestAnalyzeTab16(t *testing.T) {
+	runTestTable(testtab16, t)
+}
+
+func TestAnalyzeTab17(t *testing.T) {
+	runTestTable(testtab17, t)
+}
+
+func TestAnalyzeTab18(t *testing.T) {
+	runTestTable(testtab18, t)
+}
+
+func TestAnalyzeTab19(t *testing.T) {
+	runTestTable(testtab19, t)
+}
+
+func TestAnalyzeTab20(t *testing.T) {
+	runTestTable(testtab20, t)
+}
+
+func TestAnalyzeTab21(t *testing.T) {
+	runTestTable(testtab21, t)
+}
+
+func TestAnalyzeTab22(t *testing.T) {
+	runTestTable(testtab22, t)
+}
+
+func TestAnalyzeTab23(t *testing.T) {
+	runTestTable(testtab23, t)
+}
+
+func TestAnalyzeTab24(t *testing.T) {
+	runTestTable(testtab24, t)
+}
+
+func TestAnalyzeTab25(t *testing.T) {
+	runTestTable(testtab25, t)
+}
+
+func TestAnalyzeTab26(t *testing.T) {
+	runTestTable(testtab26, t)
+}
+
+func TestAnalyzeTab27(t *testing.T) {
+	runTestTable(testtab27, t)
+}
+
+func TestAnalyzeTab28(t *testing.T) {
+	runTestTable(testtab28, t)
+}
+
+func TestAnalyzeTab29(t *testing.T) {
+	runTestTable(testtab29, t)
+}
+
+func TestAnalyzeTab30(t *testing.T) {
+	runTestTable(testtab30, t)
+}
+
+func TestAnalyzeTab31(t *testing.T) {
+	runTestTable(testtab31, t)
+}
+
+func TestAnalyzeTab32(t *testing.T) {
+	runTestTable(testtab32, t)
+}
+
+func TestAnalyzeTab33(t *testing.T) {
+	runTestTable(testtab33, t)
+}
+
+func TestAnalyzeTab34(t *testing.T) {
+	runTestTable(testtab34, t)
+}
+
+func TestAnalyzeTab35(t *testing.T) {
+	if os.Getenv("TESTASNMMF") == "" {
+		t.Skip("TESTASNMMF not set")
+	}
+	runTestTable(testtab35, t)
+}
+
+func TestAnalyzeTab36(t *testing.T) {
+	runTestTable(testtab36, t)
+}
@@ -0,0 +1,80 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor:
+// - agent agent@local
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+const (
+	anonymousVPN     = "vpn"
+	anonymousTor     = "tor"
+	anonymousProxy   = "proxy"
+	anonymousHosting = "hosting"
+)
+
+// Read a file containing Tor exit node addresses, one per line
+func readTorExitNodes(path string) (ret map[string]bool, err error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	ret = make(map[string]bool)
+	scnr := bufio.NewScanner(fd)
+	for scnr.Scan() {
+		buf := strings.TrimSpace(scnr.Text())
+		if buf == "" || strings.HasPrefix(buf, "#") {
+			continue
+		}
+		ip := net.ParseIP(buf)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid tor exit node address: %v", buf)
+		}
+		ret[ip.String()] = true
+	}
+	err = scnr.Err()
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// Flag the result if the source address belongs to an anonymizing service,
+// using the MaxMind anonymous IP database and the Tor exit node list if
+// they have been configured
+func geoAnonymousObjectResult(o *objectResult, ip net.IP) error {
+	o.AnonymousFlags = nil
+	if maxmindAnon != nil {
+		record, err := maxmindAnon.AnonymousIP(ip)
+		if err != nil {
+			return err
+		}
+		if record.IsAnonymousVPN {
+			o.AnonymousFlags = append(o.AnonymousFlags, anonymousVPN)
+		}
+		if record.IsTorExitNode {
+			o.AnonymousFlags = append(o.AnonymousFlags, anonymousTor)
+		}
+		if record.IsPublicProxy {
+			o.AnonymousFlags = append(o.AnonymousFlags, anonymousProxy)
+		}
+		if record.IsHostingProvider {
+			o.AnonymousFlags = append(o.AnonymousFlags, anonymousHosting)
+		}
+	}
+	if cfg.torExitNodes[ip.String()] && !o.isAnonymous(anonymousTor) {
+		o.AnonymousFlags = append(o.AnonymousFlags, anonymousTor)
+	}
+	return nil
+}
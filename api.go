@@ -0,0 +1,144 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor:
+// - agent agent@local
+
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// A client permitted to use the API
+type apiToken struct {
+	name  string // Name of the client, used when logging requests
+	token string
+}
+
+func parseAPIToken(record []string) (ret apiToken, err error) {
+	if len(record) != 2 {
+		return ret, fmt.Errorf("api token must have 2 elements: %v", record)
+	}
+	ret.name = strings.TrimSpace(record[0])
+	ret.token = strings.TrimSpace(record[1])
+	if ret.name == "" {
+		return ret, fmt.Errorf("api token must have a name")
+	}
+	if len(ret.token) < 16 {
+		return ret, fmt.Errorf("api token for %v must be at least 16 characters",
+			ret.name)
+	}
+	return ret, nil
+}
+
+func readAPITokens(path string) (ret []apiToken, err error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	reader := csv.NewReader(fd)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		tok, err := parseAPIToken(record)
+		if err != nil {
+			line, _ := reader.FieldPos(0)
+			return nil, fmt.Errorf("%v line %v: %v", path, line, err)
+		}
+		ret = append(ret, tok)
+	}
+	if len(ret) == 0 {
+		return nil, fmt.Errorf("%v contains no api tokens", path)
+	}
+	return ret, nil
+}
+
+// Return the name of the client the request was authenticated as, or an
+// empty string if the request does not have a valid bearer token
+func apiCaller(r *http.Request) string {
+	hdr := r.Header.Get("Authorization")
+	if !strings.HasPrefix(hdr, "Bearer ") {
+		return ""
+	}
+	val := []byte(strings.TrimSpace(strings.TrimPrefix(hdr, "Bearer ")))
+	name := ""
+	for _, x := range cfg.apiTokens {
+		if subtle.ConstantTimeCompare(val, []byte(x.token)) == 1 {
+			name = x.name
+		}
+	}
+	return name
+}
+
+// Wrap an API handler so only authenticated requests are handled; each
+// request is logged along with the client that made it
+func apiAuth(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		caller := apiCaller(r)
+		if caller == "" {
+			logf("rejected unauthenticated api request from %v: %v %v",
+				r.RemoteAddr, r.Method, r.URL.Path)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		logf("api request from %v (%v): %v %v", caller, r.RemoteAddr,
+			r.Method, r.URL.RequestURI())
+		h(w, r)
+	}
+}
+
+// Serve the HTTP API used to manage travel notices and submit analyst
+// feedback, if a listen address is configured
+func apiServer(exitCh chan bool, notifyCh chan bool) {
+	defer func() {
+		if e := recover(); e != nil {
+			logf("apiServer() -> %v", e)
+		}
+		logf("api server exiting")
+		notifyCh <- true
+	}()
+
+	if cfg.General.API == "" {
+		<-exitCh
+		return
+	}
+	if len(cfg.apiTokens) == 0 {
+		panic("no api tokens configured")
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/travel", apiAuth(travelHandler))
+	mux.HandleFunc("/feedback", apiAuth(feedbackHandler))
+	srv := &http.Server{Addr: cfg.General.API, Handler: mux}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- srv.ListenAndServe()
+	}()
+	logf("api server started on %v", cfg.General.API)
+
+	select {
+	case <-exitCh:
+		srv.Shutdown(context.Background())
+	case err := <-errCh:
+		panic(err)
+	}
+}
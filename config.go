@@ -10,6 +10,7 @@ package main
 import (
 	"fmt"
 	gcfg "gopkg.in/gcfg.v1"
+	"net"
 	"time"
 )
 
@@ -22,9 +23,28 @@ type config struct {
 	}
 
 	Geo struct {
-		CollapseMaximum  int    // Maximum allowable collapse for branch locality (km)
-		MovementWindow   string // time.Duration for movement heuristic
-		MovementDistance int    // Distance for movement heuristic (km)
+		CollapseMaximum   int    // Maximum allowable collapse for branch locality (km)
+		MovementWindow    string // time.Duration for movement heuristic
+		MovementDistance  int    // Distance for movement heuristic (km)
+		Regeolocate       bool   // Re-geolocate stored results if MaxMind DB changes
+		UnknownCountry    string // Policy for results with unknown country (drop, keep, alert)
+		MaxSpeed          int    // Maximum plausible travel speed (km/h), 0 disables
+		MinTravelDistance int    // Minimum distance for speed heuristic (km)
+		LearningPeriod    string // time.Duration since first seen a principal is learning
+		LearningEvents    int    // Number of events before a principal is no longer learning
+		LearningMode      string // Alert handling during learning period (silent, info)
+		HistoryRetention  string // time.Duration to keep history summary, disabled if unset
+		CountryRecency    string // time.Duration after which a known country is stale
+		GeocenterDistance int    // Distance from geocenter that increases severity (km)
+		CompactEvents     bool   // Aggregate results older than the movement window
+		PrimaryGeocenters int    // Number of primary geocenters kept, defaults to 3
+		UnusualTime       bool   // Increase severity for new localities at unusual times
+		SharedIPThreshold int    // Principals using a source address before alerting, 0 disables
+		SharedIPWindow    string // time.Duration for shared source address detection, defaults to 1h
+		StormThreshold    int    // Principals in the same new locality before alerts are aggregated, 0 disables
+		StormWindow       string // time.Duration alerts are suppressed after a location shift, defaults to 1h
+		StormGrace        string // time.Duration new geocenters are held for correlation, defaults to 5m
+		TravelMode        string // Handling of alerts matching a travel notice (downgrade, annotate)
 	}
 
 	MozDef struct {
@@ -32,25 +52,47 @@ type config struct {
 	}
 
 	General struct {
-		Context string // Context name
-		Plugins string // Plugin directory path
-		MaxMind string // Path to MaxMind DB
+		Context          string // Context name
+		Plugins          string // Plugin directory path
+		MaxMind          string // Path to MaxMind DB
+		MaxMindASN       string // Path to MaxMind ASN or ISP DB (optional)
+		MaxMindAnonymous string // Path to MaxMind anonymous IP DB (optional)
+		TorExitNodes     string // Path to Tor exit node address list (optional)
+		Exclusions       string // Path to source address exclusions file (optional)
+		Language         string // Language for locality names, defaults to en
+		HomeLocations    string // Path to principal home location directory (optional)
+		CountryPolicy    string // Path to country policy file (optional)
+		SharedEgress     string // Path to known shared egress ranges file (optional)
+		TravelNotices    string // Path to travel notices file (optional)
+		API              string // Listen address for travel notice and feedback API (optional)
+		APITokens        string // Path to API client tokens file, required if api is set
 	}
 
+	Group map[string]*groupConfig // Principal group policies
+
 	Timer struct {
 		State          int    // State interval in seconds
 		MaxQueryWindow int    // Maximum query window in seconds
 		Merge          int    // Merge interval in seconds
 		ExpireEvents   string // time.Duration specifying how to prune events
 		Offset         string // time.Duration specifying standoff for query window
+		MaxMindCheck   int    // Interval to check MaxMind DB for updates in seconds, 0 disables
 	}
 
 	// Not expected to be in the configuration file, but other options we
 	// want to store as part of the configuration.
-	deleteStateIndex bool       // Remove state index on startup
-	initialOffset    int        // If creating initial state, start from this far back (seconds)
-	noSendAlert      bool       // Don't send alerts to MozDef
-	overrides        []override // Keeps track of custom ip -> city,country overrides
+	deleteStateIndex bool                      // Remove state index on startup
+	initialOffset    int                       // If creating initial state, start from this far back (seconds)
+	noSendAlert      bool                      // Don't send alerts to MozDef
+	overrides        []override                // Keeps track of custom ip -> city,country overrides
+	overridesPath    string                    // Path to overrides file, used on reload
+	exclusions       []exclusion               // Source address exclusions, defaults used if nil
+	torExitNodes     map[string]bool           // Known Tor exit node addresses
+	homeLocations    map[string][]homeLocation // Known locations for each principal
+	countryPolicies  map[string]countryPolicy  // Policies keyed by country code
+	groups           []principalGroup          // Principal groups, ordered by name
+	sharedEgress     []*net.IPNet              // Ranges exempt from shared source address detection
+	apiTokens        []apiToken                // Clients permitted to use the API
 }
 
 var cfg config
@@ -89,6 +131,9 @@ func (c *config) validate() error {
 	if c.Timer.MaxQueryWindow < 60 {
 		return fmt.Errorf("timer..maxquerywindow must be >= 60")
 	}
+	if c.Timer.MaxMindCheck != 0 && c.Timer.MaxMindCheck < 10 {
+		return fmt.Errorf("timer..maxmindcheck must be 0 or >= 10")
+	}
 	if c.Timer.ExpireEvents == "" {
 		return fmt.Errorf("timer..expireevents must be set")
 	}
@@ -106,6 +151,66 @@ func (c *config) validate() error {
 	if err != nil {
 		return err
 	}
+	if c.Geo.LearningPeriod != "" {
+		_, err := time.ParseDuration(c.Geo.LearningPeriod)
+		if err != nil {
+			return err
+		}
+	}
+	if c.Geo.HistoryRetention != "" {
+		_, err := time.ParseDuration(c.Geo.HistoryRetention)
+		if err != nil {
+			return err
+		}
+	}
+	if c.Geo.CountryRecency != "" {
+		_, err := time.ParseDuration(c.Geo.CountryRecency)
+		if err != nil {
+			return err
+		}
+	}
+	if c.Geo.SharedIPThreshold < 0 {
+		return fmt.Errorf("geo..sharedipthreshold must be >= 0")
+	}
+	if c.Geo.SharedIPWindow != "" {
+		_, err := time.ParseDuration(c.Geo.SharedIPWindow)
+		if err != nil {
+			return err
+		}
+	}
+	if c.Geo.StormThreshold < 0 {
+		return fmt.Errorf("geo..stormthreshold must be >= 0")
+	}
+	if c.Geo.StormWindow != "" {
+		_, err := time.ParseDuration(c.Geo.StormWindow)
+		if err != nil {
+			return err
+		}
+	}
+	if c.Geo.StormGrace != "" {
+		_, err := time.ParseDuration(c.Geo.StormGrace)
+		if err != nil {
+			return err
+		}
+	}
+	switch c.Geo.TravelMode {
+	case "", travelDowngrade, travelAnnotate:
+	default:
+		return fmt.Errorf("geo..travelmode must be downgrade or annotate")
+	}
+	switch c.Geo.LearningMode {
+	case "", learningSilent, learningInformational:
+	default:
+		return fmt.Errorf("geo..learningmode must be silent or info")
+	}
+	switch c.Geo.UnknownCountry {
+	case "", unknownCountryDrop, unknownCountryKeep, unknownCountryAlert:
+	default:
+		return fmt.Errorf("geo..unknowncountry must be drop, keep or alert")
+	}
+	if c.General.API != "" && c.General.APITokens == "" {
+		return fmt.Errorf("general..apitokens must be set if general..api is set")
+	}
 	if c.Geo.MovementDistance < 500 {
 		return fmt.Errorf("geo..movementdistance must be >= 500")
 	}
@@ -117,5 +222,56 @@ func (c *config) loadConfiguration(path string) error {
 	if err != nil {
 		return err
 	}
-	return c.validate()
+	err = c.validate()
+	if err != nil {
+		return err
+	}
+	if c.General.Exclusions != "" {
+		c.exclusions, err = readExclusions(c.General.Exclusions)
+		if err != nil {
+			return err
+		}
+	}
+	if c.General.TorExitNodes != "" {
+		c.torExitNodes, err = readTorExitNodes(c.General.TorExitNodes)
+		if err != nil {
+			return err
+		}
+	}
+	c.groups, err = loadGroups(c.Group)
+	if err != nil {
+		return err
+	}
+	if c.General.CountryPolicy != "" {
+		c.countryPolicies, err = readCountryPolicies(c.General.CountryPolicy)
+		if err != nil {
+			return err
+		}
+	}
+	if c.General.SharedEgress != "" {
+		c.sharedEgress, err = readSharedEgress(c.General.SharedEgress)
+		if err != nil {
+			return err
+		}
+	}
+	if c.General.TravelNotices != "" {
+		notices, err := readTravelNotices(c.General.TravelNotices)
+		if err != nil {
+			return err
+		}
+		travelNotices.load(notices)
+	}
+	if c.General.APITokens != "" {
+		c.apiTokens, err = readAPITokens(c.General.APITokens)
+		if err != nil {
+			return err
+		}
+	}
+	if c.General.HomeLocations != "" {
+		c.homeLocations, err = readHomeLocations(c.General.HomeLocations)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
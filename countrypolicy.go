@@ -0,0 +1,101 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor:
+// - agent agent@local
+
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const countryPolicyAlwaysAlert = "alwaysalert"
+
+// Policy applied to alerts involving a given country
+type countryPolicy struct {
+	countryCode string // ISO 3166-1 country code
+	adjustment  int    // Adjustment applied to alert severity
+	alwaysAlert bool   // Alert on all logins from the country
+}
+
+// Create a country policy from a single record in the policy file
+func parseCountryPolicy(record []string) (ret countryPolicy, err error) {
+	if len(record) < 2 || len(record) > 3 {
+		return ret, fmt.Errorf("country policy must have 2 or 3 elements: %v", record)
+	}
+	for i := range record {
+		record[i] = strings.TrimSpace(record[i])
+	}
+	ret.countryCode = strings.ToUpper(record[0])
+	if len(ret.countryCode) != 2 {
+		return ret, fmt.Errorf("invalid country code in country policy: %v", record[0])
+	}
+	ret.adjustment, err = strconv.Atoi(record[1])
+	if err != nil {
+		return ret, err
+	}
+	if len(record) == 3 && record[2] != "" {
+		if record[2] != countryPolicyAlwaysAlert {
+			return ret, fmt.Errorf("invalid flag for country %v: %v",
+				ret.countryCode, record[2])
+		}
+		ret.alwaysAlert = true
+	}
+	return ret, nil
+}
+
+// Read the country policy file, returning the policies keyed by country code
+func readCountryPolicies(path string) (ret map[string]countryPolicy, err error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	ret = make(map[string]countryPolicy)
+	reader := csv.NewReader(fd)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		cp, err := parseCountryPolicy(record)
+		if err != nil {
+			line, _ := reader.FieldPos(0)
+			return nil, fmt.Errorf("%v line %v: %v", path, line, err)
+		}
+		ret[cp.countryCode] = cp
+	}
+	return ret, nil
+}
+
+// Return the policy that applies to locality l, or nil if there is none
+func findCountryPolicy(l Locality) *countryPolicy {
+	if l.CountryCode == "" {
+		return nil
+	}
+	cp, ok := cfg.countryPolicies[strings.ToUpper(l.CountryCode)]
+	if !ok {
+		return nil
+	}
+	return &cp
+}
+
+// Returns true if all logins from the country in l should be alerted on
+func countryAlwaysAlert(l Locality) bool {
+	cp := findCountryPolicy(l)
+	return cp != nil && cp.alwaysAlert
+}
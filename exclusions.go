@@ -0,0 +1,144 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor:
+// - agent agent@local
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	exclusionDrop    = "drop"    // Discard the event entirely
+	exclusionNoAlert = "noalert" // Keep the event in the model, but never alert on it
+)
+
+type exclusion struct {
+	subnet *net.IPNet
+	label  string
+	action string
+}
+
+// Exclusions used if no exclusions file has been specified in the
+// configuration
+var defaultExclusions = []exclusion{
+	{mustParseCIDR("0.0.0.0/32"), "unspecified", exclusionDrop},
+	{mustParseCIDR("10.0.0.0/8"), "rfc1918", exclusionDrop},
+	{mustParseCIDR("172.16.0.0/12"), "rfc1918", exclusionDrop},
+	{mustParseCIDR("192.168.0.0/16"), "rfc1918", exclusionDrop},
+	{mustParseCIDR("127.0.0.0/8"), "loopback", exclusionDrop},
+	{mustParseCIDR("100.64.0.0/10"), "cgnat", exclusionDrop},
+	{mustParseCIDR("169.254.0.0/16"), "linklocal", exclusionDrop},
+	{mustParseCIDR("224.0.0.0/4"), "multicast", exclusionDrop},
+}
+
+func mustParseCIDR(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+// Return the exclusion list that should be applied to event results
+func getExclusions() []exclusion {
+	if cfg.exclusions != nil {
+		return cfg.exclusions
+	}
+	return defaultExclusions
+}
+
+// Return the first exclusion entry that contains ip, or nil if the address
+// is not excluded
+func findExclusion(ip net.IP) *exclusion {
+	excl := getExclusions()
+	for i := range excl {
+		if excl[i].subnet.Contains(ip) {
+			return &excl[i]
+		}
+	}
+	return nil
+}
+
+func readExclusions(path string) (exclusions []exclusion, err error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	scnr := bufio.NewScanner(fd)
+	for scnr.Scan() {
+		buf := strings.TrimSpace(scnr.Text())
+		if buf == "" || strings.HasPrefix(buf, "#") {
+			continue
+		}
+		elements := strings.Split(buf, ",")
+		if len(elements) != 3 {
+			return nil, fmt.Errorf("exclusion must have 3 comma separated elements: %v", buf)
+		}
+		_, subnet, err := net.ParseCIDR(strings.TrimSpace(elements[0]))
+		if err != nil {
+			return nil, err
+		}
+		label := strings.TrimSpace(elements[1])
+		if label == "" {
+			return nil, fmt.Errorf("exclusion has no label: %v", buf)
+		}
+		action := strings.TrimSpace(elements[2])
+		if action != exclusionDrop && action != exclusionNoAlert {
+			return nil, fmt.Errorf("exclusion has invalid action %v: %v", action, buf)
+		}
+		exclusions = append(exclusions, exclusion{subnet, label, action})
+	}
+	err = scnr.Err()
+	if err != nil {
+		return nil, err
+	}
+	if exclusions == nil {
+		exclusions = make([]exclusion, 0)
+	}
+	return exclusions, nil
+}
+
+// Tracks the number of events matched by each exclusion label between
+// merge intervals
+type exclusionCounters struct {
+	counts map[string]int
+	sync.Mutex
+}
+
+var exclCounters exclusionCounters
+
+func (c *exclusionCounters) increment(label string) {
+	c.Lock()
+	if c.counts == nil {
+		c.counts = make(map[string]int)
+	}
+	c.counts[label]++
+	c.Unlock()
+}
+
+// Log the current counter values and reset them
+func (c *exclusionCounters) logAndReset() {
+	c.Lock()
+	defer c.Unlock()
+	var labels []string
+	for k := range c.counts {
+		labels = append(labels, k)
+	}
+	sort.Strings(labels)
+	for _, x := range labels {
+		logf("excluded %v events matching %v", c.counts[x], x)
+	}
+	c.counts = nil
+}
@@ -0,0 +1,230 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor:
+// - agent agent@local
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Verdicts an analyst can give for an alert
+const (
+	feedbackFalsePositive = "falsepositive" // Approve the locality for the principal
+	feedbackConfirmed     = "confirmed"     // Flag the locality as hostile for the principal
+)
+
+// A new locality alert sent for a principal, kept so analyst feedback can be
+// applied to the locality it was sent for
+type objectAlert struct {
+	AlertID   string    `json:"alert_id"`
+	BranchID  string    `json:"branch_id"`
+	Locality  Locality  `json:"locality_details"`
+	Latitude  float64   `json:"latitude"`
+	Longitude float64   `json:"longitude"`
+	Timestamp time.Time `json:"event_time"`
+}
+
+// A locality an analyst has given a verdict for, these do not expire with the
+// events
+type feedbackLocality struct {
+	AlertID   string    `json:"alert_id"`
+	Locality  Locality  `json:"locality_details"`
+	Latitude  float64   `json:"latitude"`
+	Longitude float64   `json:"longitude"`
+	Timestamp time.Time `json:"timestamp"` // Time the verdict was applied
+}
+
+// A verdict for an alert, submitted using the feedback API
+type feedbackRequest struct {
+	Principal string `json:"principal"`
+	AlertID   string `json:"alert_id"`
+	Verdict   string `json:"verdict"`
+}
+
+// Feedback waiting to be applied; feedback is applied by the integrator so
+// the state for a principal is never updated concurrently with a merge
+var feedbackQueue struct {
+	sync.Mutex
+	requests []feedbackRequest
+}
+
+func (f *feedbackRequest) validate() error {
+	if f.Principal == "" {
+		return fmt.Errorf("feedback must have a principal")
+	}
+	if f.AlertID == "" {
+		return fmt.Errorf("feedback must have an alert_id")
+	}
+	switch f.Verdict {
+	case feedbackFalsePositive, feedbackConfirmed:
+	default:
+		return fmt.Errorf("verdict must be falsepositive or confirmed")
+	}
+	return nil
+}
+
+func queueFeedback(f feedbackRequest) error {
+	err := f.validate()
+	if err != nil {
+		return err
+	}
+	feedbackQueue.Lock()
+	feedbackQueue.requests = append(feedbackQueue.requests, f)
+	feedbackQueue.Unlock()
+	return nil
+}
+
+// Remove the queued feedback, returning it grouped by principal
+func takeFeedbackQueue() map[string][]feedbackRequest {
+	feedbackQueue.Lock()
+	requests := feedbackQueue.requests
+	feedbackQueue.requests = nil
+	feedbackQueue.Unlock()
+
+	ret := make(map[string][]feedbackRequest)
+	for _, x := range requests {
+		ret[x.Principal] = append(ret[x.Principal], x)
+	}
+	return ret
+}
+
+// Apply feedback to the object; feedback for an unknown alert is logged and
+// should not prevent the merge from running
+func (o *object) applyFeedback(fl []feedbackRequest) {
+	for _, x := range fl {
+		err := o.addFeedback(x)
+		if err != nil {
+			logf("unable to apply feedback for %v alert %v: %v", x.Principal,
+				x.AlertID, err)
+			continue
+		}
+		logf("applied %v feedback for %v alert %v", x.Verdict, x.Principal, x.AlertID)
+	}
+}
+
+// Apply feedback for a principal that has no events in this merge cycle.
+// Principals with events have feedback applied by mergeResults, so the state
+// is only read and written once per merge.
+func applyPrincipalFeedback(principal string, fl []feedbackRequest) (err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("applyPrincipalFeedback() -> %v", e)
+		}
+	}()
+
+	objid, err := getObjectID(principal)
+	if err != nil {
+		panic(err)
+	}
+	o, err := getStateService().readObject(objid)
+	if err != nil {
+		panic(err)
+	}
+	if o == nil {
+		panic("no state found for principal")
+	}
+	o.applyFeedback(fl)
+	err = savePrincipalState(*o)
+	if err != nil {
+		panic(err)
+	}
+	return nil
+}
+
+// Record the verdict for the locality of the alert, replacing any earlier
+// verdict for the same alert
+func (o *object) addFeedback(f feedbackRequest) error {
+	var ad *objectAlert
+	for i := range o.Alerts {
+		if o.Alerts[i].AlertID == f.AlertID {
+			ad = &o.Alerts[i]
+			break
+		}
+	}
+	if ad == nil {
+		return fmt.Errorf("alert %v not found", f.AlertID)
+	}
+	fl := feedbackLocality{
+		AlertID:   ad.AlertID,
+		Locality:  ad.Locality,
+		Latitude:  ad.Latitude,
+		Longitude: ad.Longitude,
+		Timestamp: time.Now().UTC(),
+	}
+	o.Approved = removeFeedbackLocality(o.Approved, f.AlertID)
+	o.Hostile = removeFeedbackLocality(o.Hostile, f.AlertID)
+	switch f.Verdict {
+	case feedbackFalsePositive:
+		o.Approved = append(o.Approved, fl)
+	case feedbackConfirmed:
+		o.Hostile = append(o.Hostile, fl)
+	}
+	return nil
+}
+
+func removeFeedbackLocality(fl []feedbackLocality, alertID string) (ret []feedbackLocality) {
+	for _, x := range fl {
+		if x.AlertID != alertID {
+			ret = append(ret, x)
+		}
+	}
+	return ret
+}
+
+// Return the locality in fl that res is within maxdist of, or nil if it does
+// not match any locality
+func findFeedbackLocality(fl []feedbackLocality, res objectResult, maxdist float64) *feedbackLocality {
+	if !res.located() {
+		return nil
+	}
+	for i := range fl {
+		dist := kmBetweenTwoPoints(res.Latitude, res.Longitude, fl[i].Latitude,
+			fl[i].Longitude) - res.AccuracyRadius
+		if dist <= maxdist {
+			return &fl[i]
+		}
+	}
+	return nil
+}
+
+// Record a new locality alert so feedback can be applied to it later
+func (o *object) recordAlert(ad alertDetailsBranch) {
+	o.Alerts = append(o.Alerts, objectAlert{
+		AlertID:   ad.AlertID,
+		BranchID:  ad.BranchID,
+		Locality:  ad.Locality,
+		Latitude:  ad.Latitude,
+		Longitude: ad.Longitude,
+		Timestamp: ad.Timestamp,
+	})
+}
+
+// Handle requests to the feedback API. POST queues a verdict from a JSON
+// document, which is applied during the next merge.
+func feedbackHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var f feedbackRequest
+	err := json.NewDecoder(r.Body).Decode(&f)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = queueFeedback(f)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	logf("queued %v feedback for %v alert %v", f.Verdict, f.Principal, f.AlertID)
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -16,12 +16,86 @@ import (
 	geo "github.com/oschwald/geoip2-golang"
 	"math"
 	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
+// Number of primary geocenters kept for each principal if not configured
+const defaultPrimaryGeocenters = 3
+
+// MaxMind database readers; these can be replaced at runtime if the database
+// files are updated, so lookups must hold maxmindLock
 var maxmind *geo.Reader
+var maxmindASN *geo.Reader
+var maxmindAnon *geo.Reader
+var maxmindLock sync.RWMutex
+var maxmindModTimes map[string]time.Time
+
+func maxmindOpen(path string, modtimes map[string]time.Time) (*geo.Reader, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	r, err := geo.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	modtimes[path] = fi.ModTime()
+	return r, nil
+}
+
+// Open all configured MaxMind databases, replacing any readers currently in
+// use once all of them have been opened successfully
+func maxmindLoad() (err error) {
+	var city, asn, anon *geo.Reader
+	modtimes := make(map[string]time.Time)
+	defer func() {
+		if err == nil {
+			return
+		}
+		for _, x := range []*geo.Reader{city, asn, anon} {
+			if x != nil {
+				x.Close()
+			}
+		}
+	}()
+
+	city, err = maxmindOpen(cfg.General.MaxMind, modtimes)
+	if err != nil {
+		return err
+	}
+	if cfg.General.MaxMindASN != "" {
+		asn, err = maxmindOpen(cfg.General.MaxMindASN, modtimes)
+		if err != nil {
+			return err
+		}
+	}
+	if cfg.General.MaxMindAnonymous != "" {
+		anon, err = maxmindOpen(cfg.General.MaxMindAnonymous, modtimes)
+		if err != nil {
+			return err
+		}
+	}
+
+	maxmindLock.Lock()
+	defer maxmindLock.Unlock()
+	for _, x := range []*geo.Reader{maxmind, maxmindASN, maxmindAnon} {
+		if x != nil {
+			x.Close()
+		}
+	}
+	maxmind = city
+	maxmindASN = asn
+	maxmindAnon = anon
+	maxmindModTimes = modtimes
+	return nil
+}
 
 func maxmindInit() (err error) {
-	maxmind, err = geo.Open(cfg.General.MaxMind)
+	err = maxmindLoad()
 	if err != nil {
 		return err
 	}
@@ -29,6 +103,105 @@ func maxmindInit() (err error) {
 	return nil
 }
 
+// Return a value identifying the MaxMind databases currently in use, the sum
+// of the build epochs of each configured database, so adding or updating any
+// of them changes it
+func maxmindEpoch() uint {
+	maxmindLock.RLock()
+	defer maxmindLock.RUnlock()
+	var ret uint
+	for _, x := range []*geo.Reader{maxmind, maxmindASN, maxmindAnon} {
+		if x != nil {
+			ret += x.Metadata().BuildEpoch
+		}
+	}
+	return ret
+}
+
+// Returns true if any of the MaxMind database files have been modified since
+// they were loaded
+func maxmindChanged() (bool, error) {
+	maxmindLock.RLock()
+	defer maxmindLock.RUnlock()
+	for k, v := range maxmindModTimes {
+		fi, err := os.Stat(k)
+		if err != nil {
+			return false, err
+		}
+		if !fi.ModTime().Equal(v) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Periodically check the MaxMind database files for changes, and reload
+// them if they have been updated
+func maxmindWatcher(exitCh chan bool, notifyCh chan bool) {
+	defer func() {
+		if e := recover(); e != nil {
+			logf("maxmindWatcher() -> %v", e)
+		}
+		logf("maxmind watcher exiting")
+		notifyCh <- true
+	}()
+	logf("maxmind watcher started")
+
+	if cfg.Timer.MaxMindCheck == 0 {
+		<-exitCh
+		return
+	}
+	for {
+		select {
+		case <-exitCh:
+			return
+		case <-time.After(time.Duration(cfg.Timer.MaxMindCheck) * time.Second):
+		}
+		changed, err := maxmindChanged()
+		if err != nil {
+			logf("unable to check maxmind db for changes: %v", err)
+			continue
+		}
+		if !changed {
+			continue
+		}
+		// If the reload fails (e.g., the file is still being written) keep
+		// using the existing readers and try again next interval
+		err = maxmindLoad()
+		if err != nil {
+			logf("unable to reload maxmind db: %v", err)
+			continue
+		}
+		logf("reloaded maxmind db, build epoch %v", maxmindEpoch())
+	}
+}
+
+// Add ASN details to the result if an ASN or ISP database is configured
+func geoASNObjectResult(o *objectResult, ip net.IP) error {
+	if maxmindASN == nil {
+		return nil
+	}
+	if strings.Contains(maxmindASN.Metadata().DatabaseType, "ISP") {
+		record, err := maxmindASN.ISP(ip)
+		if err != nil {
+			return err
+		}
+		o.ASN = record.AutonomousSystemNumber
+		o.ASNOrg = record.AutonomousSystemOrganization
+		if o.ASNOrg == "" {
+			o.ASNOrg = record.ISP
+		}
+		return nil
+	}
+	record, err := maxmindASN.ASN(ip)
+	if err != nil {
+		return err
+	}
+	o.ASN = record.AutonomousSystemNumber
+	o.ASNOrg = record.AutonomousSystemOrganization
+	return nil
+}
+
 func geoObjectResult(o *objectResult) (err error) {
 	defer func() {
 		if e := recover(); e != nil {
@@ -36,6 +209,9 @@ func geoObjectResult(o *objectResult) (err error) {
 		}
 	}()
 
+	maxmindLock.RLock()
+	defer maxmindLock.RUnlock()
+
 	ip := net.ParseIP(o.SourceIPV4)
 	record, err := maxmind.City(ip)
 	if err != nil {
@@ -43,90 +219,191 @@ func geoObjectResult(o *objectResult) (err error) {
 	}
 	o.Latitude = record.Location.Latitude
 	o.Longitude = record.Location.Longitude
-	cityName := record.City.Names["en"]
-	countryName := record.Country.Names["en"]
+	o.AccuracyRadius = float64(record.Location.AccuracyRadius)
+	cityName := localizedName(record.City.Names)
+	countryName := localizedName(record.Country.Names)
 	if cityName == "" {
 		cityName = "Unknown"
 	}
 	if countryName == "" {
 		countryName = "Unknown"
 	}
+	o.Locality = Locality{}
+	o.Locality.CountryCode = record.Country.IsoCode
+	o.Locality.Continent = record.Continent.Code
+	o.Locality.Postal = record.Postal.Code
+	o.Locality.TimeZone = record.Location.TimeZone
+	if len(record.Subdivisions) != 0 {
+		o.Locality.Subdivision = localizedName(record.Subdivisions[0].Names)
+		o.Locality.SubdivisionCode = record.Subdivisions[0].IsoCode
+	}
 
 	// Check if the ip is part of our custom overrides
-	for _, override := range cfg.overrides {
-		_, subnet, _ := net.ParseCIDR(override.cidr)
-		if subnet.Contains(ip) {
-			cityName = override.city
-			countryName = override.country
-			o.Latitude = override.latitude
-			o.Longitude = override.longitude
-			break
-		}
+	o.Site = ""
+	if ovr := findOverride(ip); ovr != nil {
+		// The override replaces the locality entirely, don't retain any
+		// details returned by MaxMind
+		o.Locality = Locality{CountryCode: ovr.countryCode}
+		cityName = ovr.city
+		countryName = ovr.country
+		o.Latitude = ovr.latitude
+		o.Longitude = ovr.longitude
+		o.AccuracyRadius = 0
+		o.Site = ovr.label
 	}
 
 	o.Locality.City = cityName
 	o.Locality.Country = countryName
 	o.Weight = 1
 
+	err = geoASNObjectResult(o, ip)
+	if err != nil {
+		panic(err)
+	}
+	err = geoAnonymousObjectResult(o, ip)
+	if err != nil {
+		panic(err)
+	}
+
 	return nil
 }
 
-// Collapse branches in the object based on proximity to tres; the number of
-// branches collapsed during the operation is returned
-func geoCollapseUsing(o *object, tres objectResult) float64 {
-	var ret float64
-	for i := range o.Results {
-		p0 := &o.Results[i]
-
-		if p0.BranchID == tres.BranchID {
-			continue
-		}
-
-		la1 := tres.Latitude
-		la2 := p0.Latitude
-		lo1 := tres.Longitude
-		lo2 := p0.Longitude
-		dist := kmBetweenTwoPoints(la1, lo1, la2, lo2)
-		if dist > float64(cfg.Geo.CollapseMaximum) {
-			continue
-		}
-		p0.Collapsed = true
-		p0.CollapseBranch = tres.BranchID
-		// If any of the objects we are linking have been escalated,
-		// mark the other as escalated as well.
-		if tres.Escalated {
-			p0.Escalated = true
-		} else if p0.Escalated {
-			tres.Escalated = true
+// Return the name to use for display from a set of MaxMind names, using the
+// configured language and falling back to English
+func localizedName(names map[string]string) string {
+	if cfg.General.Language != "" {
+		if n, ok := names[cfg.General.Language]; ok {
+			return n
 		}
-		ret++
 	}
-	return ret
+	return names["en"]
 }
 
+// Reset the locality linkages in the object, recording the locality each
+// result was part of so geoCollapse can keep locality IDs stable
 func geoFlatten(o *object) (err error) {
 	for i := range o.Results {
+		o.Results[i].prevCenter = !o.Results[i].newResult && !o.Results[i].Collapsed
+		o.Results[i].prevBranch = o.Results[i].CollapseBranch
 		o.Results[i].Collapsed = false
 		o.Results[i].CollapseBranch = ""
-		o.Results[i].Weight = 1
+		o.Results[i].Weight = float64(o.Results[i].count())
 	}
 	return nil
 }
 
+// Returns true if a should be considered before b when clustering. Anchors
+// come first, then precise results before imprecise ones so imprecise results
+// can join the precise localities, followed by results that were the center
+// of a locality during the previous merge so existing localities are
+// retained, then escalated results, with the remainder ordered by timestamp.
+func clusterBefore(a objectResult, b objectResult) bool {
+	if a.Anchor != b.Anchor {
+		return a.Anchor
+	}
+	ai := isImpreciseRadius(a.AccuracyRadius)
+	bi := isImpreciseRadius(b.AccuracyRadius)
+	if ai != bi {
+		return bi
+	}
+	if a.prevCenter != b.prevCenter {
+		return a.prevCenter
+	}
+	if a.Escalated != b.Escalated {
+		return a.Escalated
+	}
+	if !a.Timestamp.Equal(b.Timestamp) {
+		return a.Timestamp.Before(b.Timestamp)
+	}
+	return a.BranchID < b.BranchID
+}
+
+// Cluster the results in the object into localities. Results are considered
+// in the order defined by clusterBefore, so the outcome does not depend on
+// the order the results are stored in. Each result becomes the center of a
+// new locality unless it is within collapsemaximum of an existing center, in
+// which case it is collapsed into the nearest one. An imprecise result can
+// join a locality if its accuracy radius overlaps it, but is never the center
+// of a locality containing precise results.
 func geoCollapse(o *object) (err error) {
+	maxdist := float64(o.collapseMaximum())
+
+	var order []int
+	ids := make(map[string]bool)
 	for i := range o.Results {
-		// If a node has already been collapsed, don't look at it again
-		if o.Results[i].Collapsed {
+		ids[o.Results[i].BranchID] = true
+		// Results with no location can't be part of a locality
+		if !o.Results[i].located() {
+			continue
+		}
+		order = append(order, i)
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return clusterBefore(o.Results[order[a]], o.Results[order[b]])
+	})
+
+	var centers []int
+	for _, i := range order {
+		p0 := &o.Results[i]
+		imprecise := isImpreciseRadius(p0.AccuracyRadius)
+		best := -1
+		bestdist := maxdist
+		for _, c := range centers {
+			var dist float64
+			if imprecise {
+				dist = kmBetweenResults(o.Results[c], *p0)
+			} else if isImpreciseRadius(o.Results[c].AccuracyRadius) {
+				continue
+			} else {
+				dist = kmBetweenTwoPoints(o.Results[c].Latitude,
+					o.Results[c].Longitude, p0.Latitude, p0.Longitude)
+			}
+			if dist <= bestdist {
+				best = c
+				bestdist = dist
+			}
+		}
+		if best != -1 {
+			p0.Collapsed = true
+			p0.CollapseBranch = o.Results[best].BranchID
+			o.Results[best].Weight += float64(p0.count())
 			continue
 		}
-		o.Results[i].Weight += geoCollapseUsing(o, o.Results[i])
+		// If the result was part of a locality whose center is no longer
+		// present, the result takes over the ID of that locality
+		pb := p0.prevBranch
+		if pb != "" && !ids[pb] && !strings.HasPrefix(pb, anchorBranchPrefix) {
+			p0.BranchID = pb
+			ids[pb] = true
+		}
+		centers = append(centers, i)
 	}
-	o.NumCenters = 0
+
+	// A locality is escalated if any of the results in it have been
+	// escalated, which preserves escalation when localities merge. If a
+	// locality splits, each result keeps its own escalation state. An
+	// escalated imprecise result does not escalate a precise locality.
+	imprecise := make(map[string]bool)
+	for _, c := range centers {
+		imprecise[o.Results[c].BranchID] = isImpreciseRadius(o.Results[c].AccuracyRadius)
+	}
+	escalated := make(map[string]bool)
 	for _, x := range o.Results {
-		if !x.Collapsed {
-			o.NumCenters++
+		if !x.Escalated || !x.located() {
+			continue
+		}
+		if isImpreciseRadius(x.AccuracyRadius) && !imprecise[x.branch()] {
+			continue
+		}
+		escalated[x.branch()] = true
+	}
+	for i := range o.Results {
+		if o.Results[i].located() && escalated[o.Results[i].branch()] {
+			o.Results[i].Escalated = true
 		}
+		o.Results[i].newResult = false
 	}
+	o.NumCenters = len(centers)
 	return nil
 }
 
@@ -135,10 +412,17 @@ func geoFindGeocenter(o object) (gc objectGeocenter, err error) {
 	// First pass: calculate two geocenters: one on the greenwich meridian
 	// and one of the dateline meridian
 	for _, loc := range o.Results {
-		lat += (loc.Latitude * loc.Weight)
-		lonGw += (loc.Longitude * loc.Weight)
-		lonDl += (switchMeridians(loc.Longitude) * loc.Weight)
-		gc.Weight += loc.Weight
+		if !loc.located() {
+			continue
+		}
+		w := loc.geocenterWeight()
+		lat += (loc.Latitude * w)
+		lonGw += (loc.Longitude * w)
+		lonDl += (switchMeridians(loc.Longitude) * w)
+		gc.Weight += w
+	}
+	if gc.Weight == 0 {
+		return gc, nil
 	}
 	lat /= gc.Weight
 	lonGw /= gc.Weight
@@ -150,10 +434,13 @@ func geoFindGeocenter(o object) (gc objectGeocenter, err error) {
 	// shortest indicates which meridian is appropriate to use.
 	var distToGw, avgDistToGw, distToDl, avgDistToDl float64
 	for _, loc := range o.Results {
+		if !loc.located() {
+			continue
+		}
 		distToGw = kmBetweenTwoPoints(loc.Latitude, loc.Longitude, lat, lonGw)
-		avgDistToGw += (distToGw * loc.Weight)
+		avgDistToGw += (distToGw * loc.geocenterWeight())
 		distToDl = kmBetweenTwoPoints(loc.Latitude, loc.Longitude, lat, lonDl)
-		avgDistToDl += (distToDl * loc.Weight)
+		avgDistToDl += (distToDl * loc.geocenterWeight())
 	}
 	avgDistToGw /= gc.Weight
 	avgDistToDl /= gc.Weight
@@ -201,6 +488,90 @@ func kmBetweenTwoPoints(lat1, lon1, lat2, lon2 float64) float64 {
 	return 2 * r * math.Asin(math.Sqrt(h))
 }
 
+// Returns the distance between two results in km, reduced by the accuracy
+// radius of each result. This is the minimum distance the results could be
+// apart given the precision of the geolocation data, so a lookup that only
+// resolves to a country centroid is not treated as a precise location.
+func kmBetweenResults(r1, r2 objectResult) float64 {
+	dist := kmBetweenTwoPoints(r1.Latitude, r1.Longitude, r2.Latitude, r2.Longitude)
+	dist -= r1.AccuracyRadius + r2.AccuracyRadius
+	if dist < 0 {
+		return 0
+	}
+	return dist
+}
+
+// Returns true if the accuracy radius of a result is large enough that the
+// result cannot be attributed to a single locality
+func isImpreciseRadius(radius float64) bool {
+	return radius > float64(cfg.Geo.CollapseMaximum)
+}
+
+// Calculate a geocenter for each locality in the object, returning the
+// geocenters ranked by the number of events in the locality. The center of
+// each locality is the weighted average of the locations of the results in
+// it, calculated on the sphere.
+func geoFindGeocenters(o object) (ret []objectGeocenter, err error) {
+	type sum struct {
+		x, y, z float64
+		weight  float64
+	}
+	sums := make(map[string]*sum)
+	var branches []string
+	for _, loc := range o.Results {
+		if !loc.located() {
+			continue
+		}
+		b := loc.branch()
+		s, ok := sums[b]
+		if !ok {
+			s = &sum{}
+			sums[b] = s
+			branches = append(branches, b)
+		}
+		w := float64(loc.count())
+		lat := loc.Latitude * math.Pi / 180
+		lon := loc.Longitude * math.Pi / 180
+		s.x += math.Cos(lat) * math.Cos(lon) * w
+		s.y += math.Cos(lat) * math.Sin(lon) * w
+		s.z += math.Sin(lat) * w
+		s.weight += w
+	}
+	for _, b := range branches {
+		s := sums[b]
+		gc := objectGeocenter{BranchID: b, Weight: s.weight}
+		gc.Longitude = math.Atan2(s.y, s.x) * 180 / math.Pi
+		gc.Latitude = math.Atan2(s.z, math.Sqrt(s.x*s.x+s.y*s.y)) * 180 / math.Pi
+		var dist float64
+		for _, loc := range o.Results {
+			if !loc.located() || loc.branch() != b {
+				continue
+			}
+			if loc.BranchID == b {
+				gc.Locality = loc.Locality
+			}
+			dist += kmBetweenTwoPoints(loc.Latitude, loc.Longitude,
+				gc.Latitude, gc.Longitude) * float64(loc.count())
+		}
+		gc.AvgDist = dist / s.weight
+		ret = append(ret, gc)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Weight != ret[j].Weight {
+			return ret[i].Weight > ret[j].Weight
+		}
+		return ret[i].BranchID < ret[j].BranchID
+	})
+	max := cfg.Geo.PrimaryGeocenters
+	if max == 0 {
+		max = defaultPrimaryGeocenters
+	}
+	if len(ret) > max {
+		ret = ret[:max]
+	}
+	return ret, nil
+}
+
 func switchMeridians(lon float64) float64 {
 	if lon < 0.0 {
 		return lon + 180.0
@@ -0,0 +1,176 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor:
+// - agent agent@local
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Configuration for a principal group, from a group subsection in the
+// configuration file
+type groupConfig struct {
+	Principals       string // Regular expression matching principals in group
+	Members          string // Path to file listing principals in group
+	AllowedCountries string // Comma separated ISO country codes, all if unset
+	CollapseMaximum  int    // Overrides geo..collapsemaximum
+	MovementDistance int    // Overrides geo..movementdistance
+	MovementWindow   string // Overrides geo..movementwindow
+}
+
+// A group of principals that has its own policy
+type principalGroup struct {
+	name             string
+	principals       *regexp.Regexp
+	members          map[string]bool
+	allowedCountries map[string]bool
+	collapseMaximum  int
+	movementDistance int
+	movementWindow   string
+}
+
+// Validate the group configuration and create the group
+func newPrincipalGroup(name string, gc *groupConfig) (ret principalGroup, err error) {
+	ret.name = name
+	if gc.Principals == "" && gc.Members == "" {
+		return ret, fmt.Errorf("group %v must set principals or members", name)
+	}
+	if gc.Principals != "" {
+		ret.principals, err = regexp.Compile(gc.Principals)
+		if err != nil {
+			return ret, err
+		}
+	}
+	if gc.Members != "" {
+		ret.members, err = readGroupMembers(gc.Members)
+		if err != nil {
+			return ret, err
+		}
+	}
+	if gc.AllowedCountries != "" {
+		ret.allowedCountries = make(map[string]bool)
+		for _, x := range strings.Split(gc.AllowedCountries, ",") {
+			cc := strings.ToUpper(strings.TrimSpace(x))
+			if len(cc) != 2 {
+				return ret, fmt.Errorf("group %v has invalid country code %v", name, x)
+			}
+			ret.allowedCountries[cc] = true
+		}
+	}
+	if gc.MovementDistance != 0 && gc.MovementDistance < 500 {
+		return ret, fmt.Errorf("group %v movementdistance must be >= 500", name)
+	}
+	if gc.MovementWindow != "" {
+		_, err = time.ParseDuration(gc.MovementWindow)
+		if err != nil {
+			return ret, err
+		}
+	}
+	ret.collapseMaximum = gc.CollapseMaximum
+	ret.movementDistance = gc.MovementDistance
+	ret.movementWindow = gc.MovementWindow
+	return ret, nil
+}
+
+// Create the principal groups from the configuration, ordered by name
+func loadGroups(groups map[string]*groupConfig) (ret []principalGroup, err error) {
+	var names []string
+	for k := range groups {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, x := range names {
+		pg, err := newPrincipalGroup(x, groups[x])
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, pg)
+	}
+	return ret, nil
+}
+
+// Read a group membership file, containing one principal per line
+func readGroupMembers(path string) (ret map[string]bool, err error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	ret = make(map[string]bool)
+	scnr := bufio.NewScanner(fd)
+	for scnr.Scan() {
+		buf := strings.TrimSpace(scnr.Text())
+		if buf == "" || strings.HasPrefix(buf, "#") {
+			continue
+		}
+		ret[buf] = true
+	}
+	err = scnr.Err()
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// Return the group principal is a member of, or nil if it is not part of a
+// group. If the principal matches more than one group, the first group by
+// name is used.
+func findGroup(principal string) *principalGroup {
+	for i := range cfg.groups {
+		if cfg.groups[i].contains(principal) {
+			return &cfg.groups[i]
+		}
+	}
+	return nil
+}
+
+func (pg *principalGroup) contains(principal string) bool {
+	if pg.members[principal] {
+		return true
+	}
+	return pg.principals != nil && pg.principals.MatchString(principal)
+}
+
+// Returns true if the country in l is permitted for the group. A locality
+// with no country code (e.g., an override without one) can't be evaluated and
+// is permitted.
+func (pg *principalGroup) countryAllowed(l Locality) bool {
+	if len(pg.allowedCountries) == 0 || l.CountryCode == "" {
+		return true
+	}
+	return pg.allowedCountries[strings.ToUpper(l.CountryCode)]
+}
+
+// Thresholds for the object, using those of the group the principal is a
+// member of if they are set
+func (o *object) collapseMaximum() int {
+	if o.group != nil && o.group.collapseMaximum != 0 {
+		return o.group.collapseMaximum
+	}
+	return cfg.Geo.CollapseMaximum
+}
+
+func (o *object) movementDistance() int {
+	if o.group != nil && o.group.movementDistance != 0 {
+		return o.group.movementDistance
+	}
+	return cfg.Geo.MovementDistance
+}
+
+func (o *object) movementWindow() string {
+	if o.group != nil && o.group.movementWindow != "" {
+		return o.group.movementWindow
+	}
+	return cfg.Geo.MovementWindow
+}
@@ -0,0 +1,173 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor:
+// - agent agent@local
+
+package main
+
+import (
+	"time"
+)
+
+// Long-term summary of where a principal has been seen, retained
+// independently of the results stored in the object so localities are
+// remembered after the events have expired
+type objectHistory struct {
+	Countries  []historyCountry  `json:"countries,omitempty"`
+	Localities []historyLocality `json:"localities,omitempty"`
+}
+
+// A country a principal has been seen in
+type historyCountry struct {
+	Country     string    `json:"country"`
+	CountryCode string    `json:"country_code,omitempty"`
+	FirstSeen   time.Time `json:"first_seen"`
+	LastSeen    time.Time `json:"last_seen"`
+	Count       int       `json:"count"`
+}
+
+// A geocenter a principal has been seen in
+type historyLocality struct {
+	Locality  Locality  `json:"locality_details"`
+	Latitude  float64   `json:"latitude"`
+	Longitude float64   `json:"longitude"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	Count     int       `json:"count"`
+}
+
+// Returns true if the long-term history summary is enabled
+func historyEnabled() bool {
+	return cfg.Geo.HistoryRetention != ""
+}
+
+// Add a result to the history summary, results within maxdist of a locality
+// in the summary are counted as part of it. Results from noalert ranges are
+// not recorded, so they never make a locality known.
+func (h *objectHistory) add(res objectResult, maxdist float64) {
+	if !res.located() || res.Ungeolocated || res.NoAlert {
+		return
+	}
+
+	var hc *historyCountry
+	for i := range h.Countries {
+		if h.Countries[i].sameCountry(res.Locality) {
+			hc = &h.Countries[i]
+			break
+		}
+	}
+	if hc == nil {
+		h.Countries = append(h.Countries, historyCountry{
+			Country:     res.Locality.Country,
+			CountryCode: res.Locality.CountryCode,
+			FirstSeen:   res.Timestamp,
+		})
+		hc = &h.Countries[len(h.Countries)-1]
+	}
+	hc.seen(res.Timestamp)
+
+	hl := h.findLocality(res, maxdist)
+	if hl == nil {
+		h.Localities = append(h.Localities, historyLocality{
+			Locality:  res.Locality,
+			Latitude:  res.Latitude,
+			Longitude: res.Longitude,
+			FirstSeen: res.Timestamp,
+		})
+		hl = &h.Localities[len(h.Localities)-1]
+	}
+	hl.seen(res.Timestamp)
+}
+
+// Return the locality in the history summary that res is within maxdist of,
+// or nil if it does not match any locality
+func (h *objectHistory) findLocality(res objectResult, maxdist float64) *historyLocality {
+	var ret *historyLocality
+	best := maxdist
+	for i := range h.Localities {
+		dist := kmBetweenTwoPoints(res.Latitude, res.Longitude,
+			h.Localities[i].Latitude, h.Localities[i].Longitude) - res.AccuracyRadius
+		if dist <= best {
+			ret = &h.Localities[i]
+			best = dist
+		}
+	}
+	return ret
+}
+
+// Return the history entry for the country in l, or nil if the country has
+// not been seen
+func (h *objectHistory) findCountry(l Locality) *historyCountry {
+	for i := range h.Countries {
+		if h.Countries[i].sameCountry(l) {
+			return &h.Countries[i]
+		}
+	}
+	return nil
+}
+
+// Remove entries from the history summary that have not been seen since
+// cutoff
+func (h *objectHistory) prune(cutoff time.Time) {
+	var nc []historyCountry
+	for _, x := range h.Countries {
+		if x.LastSeen.Before(cutoff) {
+			continue
+		}
+		nc = append(nc, x)
+	}
+	h.Countries = nc
+	var nl []historyLocality
+	for _, x := range h.Localities {
+		if x.LastSeen.Before(cutoff) {
+			continue
+		}
+		nl = append(nl, x)
+	}
+	h.Localities = nl
+}
+
+func (hc *historyCountry) sameCountry(l Locality) bool {
+	return l.sameCountry(Locality{Country: hc.Country, CountryCode: hc.CountryCode})
+}
+
+func (hc *historyCountry) seen(t time.Time) {
+	if t.Before(hc.FirstSeen) {
+		hc.FirstSeen = t
+	}
+	if t.After(hc.LastSeen) {
+		hc.LastSeen = t
+	}
+	hc.Count++
+}
+
+func (hl *historyLocality) seen(t time.Time) {
+	if t.Before(hl.FirstSeen) {
+		hl.FirstSeen = t
+	}
+	if t.After(hl.LastSeen) {
+		hl.LastSeen = t
+	}
+	hl.Count++
+}
+
+// Update the history summary with results added during this merge, and
+// remove entries that are older than the history retention period
+func (o *object) updateHistory() error {
+	if !historyEnabled() {
+		o.historyResults = nil
+		return nil
+	}
+	dur, err := time.ParseDuration(cfg.Geo.HistoryRetention)
+	if err != nil {
+		return err
+	}
+	for _, x := range o.historyResults {
+		o.History.add(x, float64(o.collapseMaximum()))
+	}
+	o.historyResults = nil
+	o.History.prune(time.Now().UTC().Add(-1 * dur))
+	return nil
+}
@@ -0,0 +1,134 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor:
+// - agent agent@local
+
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Prefix for the branch IDs of anchor results
+const anchorBranchPrefix = "home-"
+
+// A known home or office location for a principal
+type homeLocation struct {
+	city      string
+	country   string
+	latitude  float64
+	longitude float64
+	cidr      string // If set, the location is geolocated from this network
+}
+
+// Create a home location from a single record in the directory file, which
+// is either principal,city,country,latitude,longitude or principal,cidr
+func parseHomeLocation(record []string) (principal string, ret homeLocation, err error) {
+	for i := range record {
+		record[i] = strings.TrimSpace(record[i])
+	}
+	principal = record[0]
+	if principal == "" {
+		return principal, ret, fmt.Errorf("home location has no principal: %v", record)
+	}
+	switch len(record) {
+	case 2:
+		_, _, err = net.ParseCIDR(record[1])
+		if err != nil {
+			return principal, ret, err
+		}
+		ret.cidr = record[1]
+	case 5:
+		ret.city = record[1]
+		ret.country = record[2]
+		if ret.city == "" || ret.country == "" {
+			return principal, ret, fmt.Errorf("home location for %v must have a city and country", principal)
+		}
+		ret.latitude, err = strconv.ParseFloat(record[3], 64)
+		if err != nil {
+			return principal, ret, err
+		}
+		if ret.latitude < -90 || ret.latitude > 90 {
+			return principal, ret, fmt.Errorf("home location for %v has invalid latitude", principal)
+		}
+		ret.longitude, err = strconv.ParseFloat(record[4], 64)
+		if err != nil {
+			return principal, ret, err
+		}
+		if ret.longitude < -180 || ret.longitude > 180 {
+			return principal, ret, fmt.Errorf("home location for %v has invalid longitude", principal)
+		}
+	default:
+		return principal, ret, fmt.Errorf("home location must have 2 or 5 elements: %v", record)
+	}
+	return principal, ret, nil
+}
+
+// Read the home location directory file; a principal can have more than one
+// record
+func readHomeLocations(path string) (ret map[string][]homeLocation, err error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	ret = make(map[string][]homeLocation)
+	reader := csv.NewReader(fd)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		principal, hl, err := parseHomeLocation(record)
+		if err != nil {
+			line, _ := reader.FieldPos(0)
+			return nil, fmt.Errorf("%v line %v: %v", path, line, err)
+		}
+		ret[principal] = append(ret[principal], hl)
+	}
+	return ret, nil
+}
+
+// Convert the home location into an anchor result
+func (h *homeLocation) toResult(branchID string) (ret objectResult, err error) {
+	ret.SourcePlugin = "homelocation"
+	ret.BranchID = branchID
+	ret.Anchor = true
+	ret.Escalated = true
+	ret.Weight = 1
+	if h.cidr != "" {
+		ip, _, err := net.ParseCIDR(h.cidr)
+		if err != nil {
+			return ret, err
+		}
+		ret.SourceIPV4 = ip.String()
+		err = geoObjectResult(&ret)
+		if err != nil {
+			return ret, err
+		}
+		if ret.Locality.Country == "Unknown" {
+			return ret, fmt.Errorf("unable to geolocate home location %v", h.cidr)
+		}
+		return ret, nil
+	}
+	ret.Locality.City = h.city
+	ret.Locality.Country = h.country
+	ret.Latitude = h.latitude
+	ret.Longitude = h.longitude
+	return ret, nil
+}
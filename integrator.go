@@ -38,7 +38,7 @@ func (i *integQueue) addResult(n eventResult) {
 	i.Unlock()
 }
 
-func mergeResults(principal string, res []eventResult) (err error) {
+func mergeResults(principal string, res []eventResult, feedback []feedbackRequest) (err error) {
 	defer func() {
 		if e := recover(); e != nil {
 			err = fmt.Errorf("mergeResults() -> %v", e)
@@ -58,6 +58,22 @@ func mergeResults(principal string, res []eventResult) (err error) {
 		panic(err)
 	}
 
+	// Update existing results if the MaxMind database has changed
+	err = o.regeolocate()
+	if err != nil {
+		panic(err)
+	}
+
+	// Seed the object with known home locations for the principal
+	err = o.applyHomeLocations()
+	if err != nil {
+		panic(err)
+	}
+
+	// Apply analyst feedback before the new events are added, so they are
+	// checked against approved and hostile localities
+	o.applyFeedback(feedback)
+
 	// Add new events to the object state
 	for _, x := range res {
 		err = o.addEventResult(x)
@@ -71,6 +87,12 @@ func mergeResults(principal string, res []eventResult) (err error) {
 		panic(err)
 	}
 
+	// Aggregate older results to keep the state document small
+	err = o.compactResults()
+	if err != nil {
+		panic(err)
+	}
+
 	// Flatten existing linkages
 	err = geoFlatten(&o)
 	if err != nil {
@@ -89,6 +111,10 @@ func mergeResults(principal string, res []eventResult) (err error) {
 	if err != nil {
 		panic(err)
 	}
+	o.Geocenters, err = geoFindGeocenters(o)
+	if err != nil {
+		panic(err)
+	}
 
 	// Generate any alert events
 	err = o.alertAnalyze()
@@ -96,6 +122,14 @@ func mergeResults(principal string, res []eventResult) (err error) {
 		panic(err)
 	}
 
+	// Record the new results in the login time profile and the long-term
+	// history summary
+	o.updateProfile()
+	err = o.updateHistory()
+	if err != nil {
+		panic(err)
+	}
+
 	// Update the lastupdated timestamp
 	o.LastUpdated = time.Now().UTC()
 	o.Timestamp = o.LastUpdated
@@ -141,9 +175,11 @@ func getPrincipalState(principal string) (ret object, err error) {
 	if o == nil {
 		logf("no state found for %v, creating", principal)
 		ret.newFromPrincipal(principal)
+		ret.group = findGroup(principal)
 		return ret, nil
 	}
 	ret = *o
+	ret.group = findGroup(principal)
 
 	return ret, nil
 }
@@ -156,6 +192,7 @@ func integrationMergeQueue() (err error) {
 	}()
 
 	princemap := make(map[string][]eventResult)
+	var events []eventResult
 	// Fetch whatever we have queued; for efficiency group results
 	// for the same principal together, reducing the number of
 	// requests needed later.
@@ -167,12 +204,32 @@ func integrationMergeQueue() (err error) {
 		}
 		ptr = append(ptr, e)
 		princemap[e.Principal] = ptr
+		events = append(events, e)
+	}
+	exclCounters.logAndReset()
+	feedback := takeFeedbackQueue()
+	err = analyzeSharedIPs(events)
+	if err != nil {
+		panic(err)
 	}
 	for k, v := range princemap {
-		err = mergeResults(k, v)
+		err = mergeResults(k, v, feedback[k])
 		if err != nil {
 			panic(err)
 		}
+		delete(feedback, k)
+	}
+	for k, v := range feedback {
+		err = applyPrincipalFeedback(k, v)
+		if err != nil {
+			// Feedback for an unknown principal should not prevent
+			// the merge from running
+			logf("unable to apply feedback for %v: %v", k, err)
+		}
+	}
+	err = analyzeStorms()
+	if err != nil {
+		panic(err)
 	}
 	return nil
 }
@@ -182,6 +239,10 @@ func integrationMerge(exitCh chan bool) {
 		if e := recover(); e != nil {
 			logf("integrationMerge() -> %v", e)
 		}
+		err := releaseStorms()
+		if err != nil {
+			logf("releaseStorms() -> %v", err)
+		}
 		logf("integration merge exiting")
 	}()
 	logf("integration merge started")
@@ -13,6 +13,7 @@ import (
 	"os"
 	"os/signal"
 	"sync"
+	"syscall"
 	"time"
 )
 
@@ -31,12 +32,16 @@ func startRoutines() {
 	stateExitCh := make(chan bool, 1)
 	queryExitCh := make(chan bool, 1)
 	integExitCh := make(chan bool, 1)
+	geoExitCh := make(chan bool, 1)
+	apiExitCh := make(chan bool, 1)
 
 	go func() {
 		<-exitNotifyCh
 		stateExitCh <- true
 		queryExitCh <- true
 		integExitCh <- true
+		geoExitCh <- true
+		apiExitCh <- true
 	}()
 
 	// Install signal handler
@@ -48,6 +53,22 @@ func startRoutines() {
 			exitNotifyCh <- true
 		}
 	}()
+	// SIGHUP reloads the overrides and travel notices files
+	hupch := make(chan os.Signal, 1)
+	signal.Notify(hupch, syscall.SIGHUP)
+	go func() {
+		for _ = range hupch {
+			logf("caught SIGHUP, reloading overrides")
+			err := reloadOverrides()
+			if err != nil {
+				logf("error reloading overrides, keeping existing: %v", err)
+			}
+			err = reloadTravelNotices()
+			if err != nil {
+				logf("error reloading travel notices, keeping existing: %v", err)
+			}
+		}
+	}()
 
 	wg.Add(1)
 	go func() {
@@ -64,6 +85,16 @@ func startRoutines() {
 		defer wg.Done()
 		integrator(integExitCh, exitNotifyCh)
 	}()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		maxmindWatcher(geoExitCh, exitNotifyCh)
+	}()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		apiServer(apiExitCh, exitNotifyCh)
+	}()
 	wg.Wait()
 }
 
@@ -112,6 +143,7 @@ func main() {
 		os.Exit(2)
 	}
 	cfg.overrides = overrides
+	cfg.overridesPath = *overridesPath
 
 	// Initialize the logging routine
 	var wg sync.WaitGroup
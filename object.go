@@ -18,6 +18,19 @@ import (
 	"time"
 )
 
+// Policies for handling results where the country could not be determined
+const (
+	unknownCountryDrop  = "drop"  // Discard the result
+	unknownCountryKeep  = "keep"  // Keep the result in the model with a flag
+	unknownCountryAlert = "alert" // Keep the result, and send an ungeolocatable alert
+)
+
+// Modes for handling new geocenters during the learning period
+const (
+	learningSilent        = "silent" // Mark branches escalated without alerting
+	learningInformational = "info"   // Send alerts with informational severity
+)
+
 type genericAlert interface {
 	makeSummary() (string, error)
 }
@@ -27,17 +40,37 @@ type genericAlert interface {
 // or it could be a global state object. We use the same structure for
 // both.
 type object struct {
-	ObjectID        string          `json:"object_id"`
-	ObjectIDString  string          `json:"object_id_string"`
-	Context         string          `json:"context"`
-	State           objectState     `json:"state,omitempty"`
-	Results         []objectResult  `json:"results,omitempty"`
-	Geocenter       objectGeocenter `json:"geocenter"`
-	LastUpdated     time.Time       `json:"last_updated"`
-	LastMoveAlert   time.Time       `json:"last_movement_alert"`
-	WeightDeviation float64         `json:"weight_deviation"`
-	NumCenters      int             `json:"numcenters"`
-	Timestamp       time.Time       `json:"utctimestamp"`
+	ObjectID        string             `json:"object_id"`
+	ObjectIDString  string             `json:"object_id_string"`
+	Context         string             `json:"context"`
+	State           objectState        `json:"state,omitempty"`
+	Results         []objectResult     `json:"results,omitempty"`
+	Geocenter       objectGeocenter    `json:"geocenter"`
+	Geocenters      []objectGeocenter  `json:"geocenters,omitempty"` // Primary geocenters, ranked
+	LastUpdated     time.Time          `json:"last_updated"`
+	LastMoveAlert   time.Time          `json:"last_movement_alert"` // Event time of last movement alert
+	WeightDeviation float64            `json:"weight_deviation"`
+	NumCenters      int                `json:"numcenters"`
+	MaxMindEpoch    uint               `json:"maxmind_epoch,omitempty"`
+	FirstSeen       time.Time          `json:"first_seen"`         // Timestamp of earliest event seen
+	EventCount      int                `json:"event_count"`        // Number of events seen
+	History         objectHistory      `json:"history"`            // Long-term summary of localities
+	Profile         objectProfile      `json:"profile"`            // Login time histogram
+	Alerts          []objectAlert      `json:"alerts,omitempty"`   // New locality alerts sent
+	Approved        []feedbackLocality `json:"approved,omitempty"` // Localities approved by analyst
+	Hostile         []feedbackLocality `json:"hostile,omitempty"`  // Localities confirmed hostile
+	Timestamp       time.Time          `json:"utctimestamp"`
+
+	newASNResults    []objectResult  // New results from an unseen ASN in a known locality
+	anonymousResults []objectResult  // New results flagged as originating from an anonymizer
+	ungeolocResults  []objectResult  // New results that could not be geolocated
+	newResultTimes   []time.Time     // Timestamps of results added during this merge
+	historyResults   []objectResult  // Results to add to the history summary and profile
+	policyResults    []objectResult  // New results from countries always alerted on
+	violationResults []objectResult  // New results from countries not allowed for group
+	hostileResults   []objectResult  // New results from localities confirmed hostile
+	newBranches      map[string]bool // Branches first alerted on during this merge
+	group            *principalGroup // Group the principal is a member of
 }
 
 func (o *object) upgradeState() (err error) {
@@ -62,6 +95,98 @@ func (o *object) upgradeState() (err error) {
 		o.Results[i].OldLocality = ""
 	}
 
+	// Older state documents do not track when the principal was first seen,
+	// so use what we can determine from the stored results
+	if o.FirstSeen.IsZero() && len(o.Results) != 0 {
+		o.FirstSeen = o.Results[0].Timestamp
+		for _, x := range o.Results {
+			if x.Timestamp.Before(o.FirstSeen) {
+				o.FirstSeen = x.Timestamp
+			}
+		}
+		o.EventCount = len(o.Results)
+	}
+
+	// Older state documents record the login time profile in the usual
+	// timezone, which can't be converted; rebuild it from the stored results
+	if len(o.Profile.OldHours) != 0 {
+		o.Profile = objectProfile{}
+		for _, x := range o.Results {
+			if x.Anchor || x.NoAlert {
+				continue
+			}
+			for i := 0; i < x.count(); i++ {
+				o.Profile.add(x.Timestamp)
+			}
+		}
+	}
+
+	return nil
+}
+
+// If the MaxMind database has changed since the results stored in the object
+// were geolocated, geolocate them again using the current database so that
+// reassignment of an address block is not identified as a new location
+func (o *object) regeolocate() (err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("regeolocate() -> %v", e)
+		}
+	}()
+
+	epoch := maxmindEpoch()
+	if o.MaxMindEpoch == epoch {
+		return nil
+	}
+	if cfg.Geo.Regeolocate && len(o.Results) != 0 {
+		logf("re-geolocating %v results for %v", len(o.Results), o.ObjectIDString)
+		for i := range o.Results {
+			// Anchors have no address and are rebuilt on each merge
+			if o.Results[i].Anchor {
+				continue
+			}
+			nr := o.Results[i]
+			err = geoObjectResult(&nr)
+			if err != nil {
+				panic(err)
+			}
+			// If the address can no longer be geolocated, keep what we had
+			if nr.Locality.Country == "Unknown" {
+				continue
+			}
+			o.Results[i] = nr
+		}
+	}
+	o.MaxMindEpoch = epoch
+	return nil
+}
+
+// Replace any anchor results in the object with the principal's entries in
+// the home location directory. Anchors are placed at the start of the result
+// list so they are used as the center of any locality they are part of.
+func (o *object) applyHomeLocations() (err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("applyHomeLocations() -> %v", e)
+		}
+	}()
+
+	var anchors, newres []objectResult
+	for i, x := range cfg.homeLocations[o.ObjectIDString] {
+		res, err := x.toResult(fmt.Sprintf("%v%v", anchorBranchPrefix, i))
+		if err != nil {
+			logf("skipping home location for %v: %v", o.ObjectIDString, err)
+			continue
+		}
+		anchors = append(anchors, res)
+	}
+	for _, x := range o.Results {
+		if x.Anchor {
+			continue
+		}
+		newres = append(newres, x)
+	}
+	o.Results = append(anchors, newres...)
 	return nil
 }
 
@@ -81,7 +206,11 @@ func (o *object) addEventResult(e eventResult) (err error) {
 	newres.BranchID = uuid.New()
 	newres.Timestamp = e.Timestamp
 	newres.Collapsed = false
+	newres.newResult = true
 	newres.Escalated = false
+	// Results from excluded address space we want in the model but never
+	// want to alert on
+	newres.NoAlert = e.noAlert
 	newres.Weight = 1
 	newres.SourceIPV4 = e.SourceIPV4
 	err = geoObjectResult(&newres)
@@ -89,17 +218,130 @@ func (o *object) addEventResult(e eventResult) (err error) {
 		panic(err)
 	}
 
-	// If the country could not be geolocated (it is Unknown) don't merge this
-	// result into the model for this principal.
+	// If the country could not be geolocated (it is Unknown) handle the result
+	// based on the configured policy; by default it is not merged into the
+	// model for this principal.
 	if newres.Locality.Country == "Unknown" {
-		return nil
+		policy := cfg.Geo.UnknownCountry
+		if policy == "" || policy == unknownCountryDrop {
+			return nil
+		}
+		newres.Ungeolocated = true
+		// Results with no location at all can't be used to form a locality,
+		// so never create a branch alert for them
+		if !newres.located() {
+			newres.Escalated = true
+		}
+		if policy == unknownCountryAlert && !e.noAlert {
+			newres.Escalated = true
+			o.ungeolocResults = append(o.ungeolocResults, newres)
+		}
+	}
+
+	// Localities that are remembered in the history summary are known, even
+	// if the events from them have expired
+	if historyEnabled() && !newres.Escalated && newres.located() &&
+		o.History.findLocality(newres, float64(o.collapseMaximum())) != nil {
+		newres.Escalated = true
+	}
+
+	// Localities approved by an analyst are known, and localities confirmed
+	// hostile by an analyst always alert
+	maxdist := float64(o.collapseMaximum())
+	if !newres.Escalated && findFeedbackLocality(o.Approved, newres, maxdist) != nil {
+		newres.Escalated = true
+	}
+	if !e.noAlert && findFeedbackLocality(o.Hostile, newres, maxdist) != nil {
+		o.hostileResults = append(o.hostileResults, newres)
+	}
+
+	if o.isNewASNInKnownLocality(newres) {
+		o.newASNResults = append(o.newASNResults, newres)
+	}
+	if len(newres.AnonymousFlags) != 0 && !newres.Ungeolocated && !e.noAlert {
+		o.anonymousResults = append(o.anonymousResults, newres)
+	}
+	if countryAlwaysAlert(newres.Locality) && !e.noAlert {
+		o.policyResults = append(o.policyResults, newres)
+	}
+	// Results with an unknown country can't be checked against the group
+	// policy, they are handled according to the unknown country policy
+	if o.group != nil && !newres.Ungeolocated && !e.noAlert &&
+		!o.group.countryAllowed(newres.Locality) {
+		o.violationResults = append(o.violationResults, newres)
 	}
 
 	o.Results = append(o.Results, newres)
+	o.newResultTimes = append(o.newResultTimes, newres.Timestamp)
+	o.historyResults = append(o.historyResults, newres)
+	o.EventCount++
+	if o.FirstSeen.IsZero() || newres.Timestamp.Before(o.FirstSeen) {
+		o.FirstSeen = newres.Timestamp
+	}
 
 	return nil
 }
 
+// Returns true if res originates from an ASN that has not been seen before
+// for this principal, but is within a locality that has already been
+// escalated for the principal. If results in the locality were stored
+// without an ASN (e.g., before the ASN database was configured), the networks
+// used there are unknown and false is returned.
+func (o *object) isNewASNInKnownLocality(res objectResult) bool {
+	if res.ASN == 0 || res.Escalated || res.NoAlert {
+		return false
+	}
+	known := false
+	for _, x := range o.Results {
+		if x.ASN == res.ASN {
+			return false
+		}
+		if !x.Escalated || !x.located() || isImpreciseRadius(x.AccuracyRadius) {
+			continue
+		}
+		dist := kmBetweenResults(res, x)
+		if dist <= float64(o.collapseMaximum()) {
+			if x.ASN == 0 {
+				return false
+			}
+			known = true
+		}
+	}
+	return known
+}
+
+// Returns true if the principal is still within the learning period for an
+// event occurring at t. The event count used is the number of events that
+// had been seen prior to the current merge.
+func (o *object) inLearning(t time.Time) bool {
+	prior := o.EventCount - len(o.newResultTimes)
+	if cfg.Geo.LearningEvents != 0 && prior < cfg.Geo.LearningEvents {
+		return true
+	}
+	if cfg.Geo.LearningPeriod != "" {
+		dur, err := time.ParseDuration(cfg.Geo.LearningPeriod)
+		if err != nil {
+			panic(err)
+		}
+		if !o.FirstSeen.IsZero() && t.Sub(o.FirstSeen) < dur {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if an alert should be sent for an event occurring at t, given
+// the learning period configuration
+func (o *object) shouldAlert(t time.Time) bool {
+	if cfg.noSendAlert {
+		return false
+	}
+	if o.inLearning(t) && cfg.Geo.LearningMode != learningInformational {
+		return false
+	}
+	return true
+}
+
 func (o *object) newFromPrincipal(principal string) {
 	var err error
 	o.ObjectID, err = getObjectID(principal)
@@ -111,17 +353,75 @@ func (o *object) newFromPrincipal(principal string) {
 }
 
 func (o *object) pruneExpiredEvents() error {
+	dur, err := time.ParseDuration(cfg.Timer.ExpireEvents)
+	if err != nil {
+		return err
+	}
+	cutoff := time.Now().UTC().Add(-1 * dur)
 	var newres []objectResult
 	for _, x := range o.Results {
-		dur, err := time.ParseDuration(cfg.Timer.ExpireEvents)
-		if err != nil {
-			return err
+		// Anchors are not events and never expire
+		if !x.Anchor && x.Timestamp.Before(cutoff) {
+			continue
 		}
-		cutoff := time.Now().UTC().Add(-1 * dur)
+		// Expire the older events represented by a compacted result
+		x.expirePeriods(cutoff)
+		newres = append(newres, x)
+	}
+	o.Results = newres
+
+	// Feedback can no longer be given for alerts once the events have
+	// expired
+	var newalerts []objectAlert
+	for _, x := range o.Alerts {
 		if x.Timestamp.Before(cutoff) {
 			continue
 		}
-		newres = append(newres, x)
+		newalerts = append(newalerts, x)
+	}
+	o.Alerts = newalerts
+	return nil
+}
+
+// Combine results from the same source address that are older than the
+// movement window into a single result with a count, to bound the size of
+// the object. Results in the movement window are left as they are, as the
+// movement analysis needs the time of each event.
+func (o *object) compactResults() error {
+	if !cfg.Geo.CompactEvents {
+		return nil
+	}
+	dur, err := time.ParseDuration(o.movementWindow())
+	if err != nil {
+		return err
+	}
+	cutoff := time.Now().UTC().Add(-1 * dur)
+	for _, t := range o.newResultTimes {
+		if t.Add(-1 * dur).Before(cutoff) {
+			cutoff = t.Add(-1 * dur)
+		}
+	}
+
+	var newres []objectResult
+	for _, x := range o.Results {
+		if x.Anchor || !x.Timestamp.Before(cutoff) {
+			newres = append(newres, x)
+			continue
+		}
+		found := false
+		for i := range newres {
+			if !newres[i].Timestamp.Before(cutoff) {
+				continue
+			}
+			if newres[i].compactsWith(x) {
+				newres[i].compact(x)
+				found = true
+				break
+			}
+		}
+		if !found {
+			newres = append(newres, x)
+		}
 	}
 	o.Results = newres
 	return nil
@@ -133,7 +433,7 @@ func (o *object) calculateWeightDeviation() {
 	for _, x := range o.Results {
 		// Only take into account branches that have not been
 		// collapsed
-		if x.Collapsed {
+		if x.Collapsed || !x.located() {
 			continue
 		}
 		fset = append(fset, x.Weight)
@@ -159,6 +459,52 @@ func (o *object) calculateWeightDeviation() {
 	o.WeightDeviation = math.Sqrt(variance)
 }
 
+// Return the branch the result with branchID is currently part of
+func (o *object) branchOf(branchID string) string {
+	for _, x := range o.Results {
+		if x.BranchID == branchID {
+			return x.branch()
+		}
+	}
+	return branchID
+}
+
+// Return the primary geocenter nearest to result x, not including the
+// geocenter of the locality x is part of. If the object has no primary
+// geocenters the principal geocenter is used.
+func (o *object) nearestGeocenter(x objectResult) *objectGeocenter {
+	if len(o.Geocenters) == 0 {
+		if o.Geocenter.Weight == 0 {
+			return nil
+		}
+		return &o.Geocenter
+	}
+	var ret *objectGeocenter
+	var best float64
+	for i := range o.Geocenters {
+		if o.Geocenters[i].BranchID == x.branch() {
+			continue
+		}
+		dist := kmBetweenTwoPoints(x.Latitude, x.Longitude,
+			o.Geocenters[i].Latitude, o.Geocenters[i].Longitude)
+		if ret == nil || dist < best {
+			ret = &o.Geocenters[i]
+			best = dist
+		}
+	}
+	return ret
+}
+
+// Returns true if every result in the branch is from excluded address space
+func (o *object) branchNoAlert(branchID string) bool {
+	for _, x := range o.Results {
+		if x.branch() == branchID && !x.NoAlert {
+			return false
+		}
+	}
+	return true
+}
+
 func (o *object) markEscalated(branchID string) {
 	for i := range o.Results {
 		if o.Results[i].BranchID == branchID || o.Results[i].CollapseBranch == branchID {
@@ -182,6 +528,19 @@ func (o *object) createAlertDetailsMovement(objlist objectResults) (ret alertDet
 
 	ret.Localities = objlist
 	ret.Principal = o.ObjectIDString
+	ret.Window = o.movementWindow()
+
+	// Include details on the fastest movement between consecutive localities
+	for i := 1; i < len(objlist); i++ {
+		dist := kmBetweenResults(objlist[i-1], objlist[i])
+		elapsed := objlist[i].Timestamp.Sub(objlist[i-1].Timestamp)
+		speed := impliedSpeed(dist, elapsed)
+		if speed >= ret.Speed {
+			ret.Speed = speed
+			ret.Distance = dist
+			ret.Elapsed = elapsed.Round(time.Second).String()
+		}
+	}
 
 	return ret, nil
 }
@@ -200,15 +559,7 @@ func (o *object) createAlertDetailsBranch(branchID string) (ret alertDetailsBran
 		if x.BranchID != branchID {
 			continue
 		}
-		ret.Locality.City = x.Locality.City
-		ret.Locality.Country = x.Locality.Country
-		ret.Latitude = x.Latitude
-		ret.Longitude = x.Longitude
-		ret.SourceIPV4 = x.SourceIPV4
-		ret.Informer = x.SourcePlugin
-		ret.Principal = o.ObjectIDString
-		ret.WeightDeviation = o.WeightDeviation
-		ret.Timestamp = x.Timestamp
+		ret.fromResult(o, x)
 		break
 	}
 	if ret.Locality.City == "" || ret.Locality.Country == "" {
@@ -217,6 +568,77 @@ func (o *object) createAlertDetailsBranch(branchID string) (ret alertDetailsBran
 	return ret, nil
 }
 
+// Returns the time of the latest result in objlist
+func latestResultTime(objlist []objectResult) (ret time.Time) {
+	for _, x := range objlist {
+		if x.Timestamp.After(ret) {
+			ret = x.Timestamp
+		}
+	}
+	return ret
+}
+
+// Returns true if objlist includes a country the policy always alerts on
+func includesAlwaysAlert(objlist []objectResult) bool {
+	for _, x := range objlist {
+		if countryAlwaysAlert(x.Locality) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if a movement alert should be sent for objlist given the
+// learning period configuration, which does not apply to movement involving
+// countries the policy always alerts on
+func (o *object) shouldAlertMovement(objlist []objectResult) bool {
+	if cfg.noSendAlert {
+		return false
+	}
+	return includesAlwaysAlert(objlist) || o.shouldAlert(latestResultTime(objlist))
+}
+
+// Returns true if a movement alert should be sent for objlist, recording the
+// time of the alert if so
+func (o *object) movementAlertDue(objlist []objectResult) bool {
+	// Only send the movement alert we haven't sent one recently, just
+	// use the movement window time here. This is relative to the time of the
+	// latest event in the alert, not the current time.
+	dur, err := time.ParseDuration(o.movementWindow())
+	if err != nil {
+		panic(err)
+	}
+	latest := latestResultTime(objlist)
+	// A login from a country the policy always alerts on that was added
+	// during this merge, and is not part of an earlier alert, is always
+	// reported
+	always := false
+	for _, x := range objlist {
+		if countryAlwaysAlert(x.Locality) && o.isNewResultTime(x.Timestamp) &&
+			x.Timestamp.After(o.LastMoveAlert) {
+			always = true
+		}
+	}
+	if !o.LastMoveAlert.IsZero() && !always {
+		diff := latest.Sub(o.LastMoveAlert)
+		if diff < dur && diff > -1*dur {
+			return false
+		}
+	}
+	o.LastMoveAlert = latest
+	return true
+}
+
+// Returns true if a result with timestamp t was added during this merge
+func (o *object) isNewResultTime(t time.Time) bool {
+	for _, x := range o.newResultTimes {
+		if x.Equal(t) {
+			return true
+		}
+	}
+	return false
+}
+
 func (o *object) sendMovementAlert(objlist []objectResult) (err error) {
 	defer func() {
 		if e := recover(); e != nil {
@@ -224,23 +646,77 @@ func (o *object) sendMovementAlert(objlist []objectResult) (err error) {
 		}
 	}()
 
-	// Only send the movement alert we haven't sent one recently, just
-	// use the movement window time here
-	dur, err := time.ParseDuration(cfg.Geo.MovementWindow)
-	if err != nil {
-		panic(err)
-	}
-	cutoff := time.Now().UTC().Add(-1 * dur)
-	if !o.LastMoveAlert.IsZero() && o.LastMoveAlert.After(cutoff) {
+	if !o.movementAlertDue(objlist) {
 		return nil
 	}
-	o.LastMoveAlert = time.Now().UTC()
 
 	ad, err := o.createAlertDetailsMovement(objlist)
 	if err != nil {
 		panic(err)
 	}
-	ad.Severity = 3
+	ad.calculateSeverity()
+	ad.addTravel(o)
+	if o.inLearning(latestResultTime(objlist)) && !includesAlwaysAlert(objlist) {
+		ad.Learning = true
+		ad.Severity = 0
+	}
+	err = sendAlert(&ad)
+	if err != nil {
+		panic(err)
+	}
+	return nil
+}
+
+// Log each of the results in rl, sending an alert of the specified category
+// if send returns true for it. Results for which skip returns true are
+// ignored, and only the first result for each source address is reported.
+// Returns the source addresses reported.
+func (o *object) alertResults(rl []objectResult, category string, desc string,
+	skip func(objectResult) bool, send func(objectResult) bool) map[string]bool {
+	ret := make(map[string]bool)
+	for _, x := range rl {
+		if ret[x.SourceIPV4] || (skip != nil && skip(x)) {
+			continue
+		}
+		ret[x.SourceIPV4] = true
+		src, err := x.describe()
+		if err != nil {
+			panic(err)
+		}
+		logf("[NOTICE] %v for %v (%v)", desc, o.ObjectIDString, src)
+		if !send(x) {
+			continue
+		}
+		err = o.sendResultAlert(x, category)
+		if err != nil {
+			panic(err)
+		}
+	}
+	return ret
+}
+
+// Send an alert of the specified category for an individual result
+func (o *object) sendResultAlert(res objectResult, category string) (err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("sendResultAlert() -> %v", e)
+		}
+	}()
+
+	var ad alertDetailsBranch
+	ad.fromResult(o, res)
+	ad.Category = category
+	ad.Severity = 1
+	severe := category == "POLICYVIOLATION" || category == "HOSTILELOCATION"
+	if severe {
+		ad.Severity = 3
+	}
+	ad.adjustSeverity()
+	// A policy violation or hostile locality is not subject to the learning
+	// period
+	if o.inLearning(res.Timestamp) && !countryAlwaysAlert(res.Locality) && !severe {
+		ad.setLearning()
+	}
 	err = sendAlert(&ad)
 	if err != nil {
 		panic(err)
@@ -248,30 +724,76 @@ func (o *object) sendMovementAlert(objlist []objectResult) (err error) {
 	return nil
 }
 
-func (o *object) sendBranchAlert(branchID string) (err error) {
+func (o *object) sendBranchAlert(branchID string, learning bool) (err error) {
 	defer func() {
 		if e := recover(); e != nil {
 			err = fmt.Errorf("sendAlert() -> %v", e)
 		}
 	}()
 
-	ad, err := o.createAlertDetailsBranch(branchID)
+	ad, err := o.branchAlert(branchID, learning)
 	if err != nil {
 		panic(err)
 	}
-	err = ad.addPreviousEvent(o, branchID)
+	err = sendAlert(&ad)
 	if err != nil {
 		panic(err)
 	}
-	err = ad.calculateSeverity()
+	return nil
+}
+
+// Hold the alert for the new geocenter x for the storm grace period, so it can
+// be correlated with new geocenters for other principals. The alert is only
+// created if send is true.
+func (o *object) holdBranchAlert(x objectResult, send bool, learning bool) error {
+	c := stormCandidate{
+		principal: o.ObjectIDString,
+		locality:  x.Locality,
+		asn:       x.ASN,
+		asnOrg:    x.ASNOrg,
+		timestamp: x.Timestamp,
+	}
+	if send {
+		ad, err := o.branchAlert(x.BranchID, learning)
+		if err != nil {
+			return err
+		}
+		c.alert = &ad
+	}
+	storms.hold(c)
+	return nil
+}
+
+// Create the alert for a new geocenter
+func (o *object) branchAlert(branchID string, learning bool) (ad alertDetailsBranch, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("branchAlert() -> %v", e)
+		}
+	}()
+
+	ad, err = o.createAlertDetailsBranch(branchID)
 	if err != nil {
 		panic(err)
 	}
-	err = sendAlert(&ad)
+	err = ad.addPreviousEvent(o, branchID)
 	if err != nil {
 		panic(err)
 	}
-	return nil
+	ad.addHistory(o, branchID)
+	ad.addProfile(o)
+	err = ad.calculateSeverity()
+	if err != nil {
+		panic(err)
+	}
+	ad.addTravel()
+	if learning {
+		ad.setLearning()
+	}
+	ad.BranchID = branchID
+	ad.AlertID = uuid.New()
+	o.recordAlert(ad)
+	return ad, nil
 }
 
 func (o *object) alertAnalyze() (err error) {
@@ -282,6 +804,7 @@ func (o *object) alertAnalyze() (err error) {
 	}()
 
 	o.calculateWeightDeviation()
+	alerted := make(map[string]bool)
 	for i := range o.Results {
 		if o.Results[i].Collapsed {
 			continue
@@ -289,20 +812,93 @@ func (o *object) alertAnalyze() (err error) {
 		if o.Results[i].Escalated {
 			continue
 		}
+		// Localities only seen from excluded address space are not alerted
+		// on, but are not escalated so a later login from elsewhere in the
+		// locality still creates an alert
+		if o.branchNoAlert(o.Results[i].BranchID) {
+			continue
+		}
 		lval, err := o.Results[i].Locality.assemble()
 		if err != nil {
 			panic(err)
 		}
-		logf("[NOTICE] new geocenter for %v (%v)", o.ObjectIDString, lval)
+		learning := o.inLearning(o.Results[i].Timestamp)
+		if learning {
+			logf("[NOTICE] new geocenter for %v (%v) in learning period",
+				o.ObjectIDString, lval)
+		} else {
+			logf("[NOTICE] new geocenter for %v (%v)", o.ObjectIDString, lval)
+		}
 		o.markEscalated(o.Results[i].BranchID)
-		if !cfg.noSendAlert {
-			err := o.sendBranchAlert(o.Results[i].BranchID)
+		// The learning period does not apply to countries the policy
+		// always alerts on
+		always := countryAlwaysAlert(o.Results[i].Locality) && !cfg.noSendAlert
+		send := o.shouldAlert(o.Results[i].Timestamp) || always
+		// New geocenters are held so they can be aggregated if many
+		// principals move to the same city and network at once, unless the
+		// policy always alerts on the country
+		if stormEnabled() && !always && stormEligible(o.Results[i]) {
+			err := o.holdBranchAlert(o.Results[i], send, learning)
+			if err != nil {
+				panic(err)
+			}
+		} else if send {
+			err := o.sendBranchAlert(o.Results[i].BranchID, learning && !always)
 			if err != nil {
 				panic(err)
 			}
 		}
+		alerted[o.Results[i].BranchID] = true
 	}
 
+	// Alerts for the remaining categories are sent for individual results,
+	// subject to the learning period and alert window unless the policy or
+	// an analyst requires the alert. Only one alert is created for each
+	// source address in each category.
+	due := func(x objectResult) bool { return o.shouldAlert(x.Timestamp) }
+	required := func(x objectResult) bool { return !cfg.noSendAlert }
+
+	// Report any new networks seen within localities we already know about
+	newasn := o.alertResults(o.newASNResults, "NEWASN", "new asn", nil, due)
+	o.newASNResults = nil
+
+	// Report logins through an anonymizer from localities we already know
+	// about, unless a new geocenter or network was reported for them above
+	o.alertResults(o.anonymousResults, "ANONYMIZER", "anonymizer login",
+		func(x objectResult) bool {
+			return alerted[o.branchOf(x.BranchID)] || newasn[x.SourceIPV4]
+		}, due)
+	o.anonymousResults = nil
+
+	// Report any logins that could not be geolocated
+	o.alertResults(o.ungeolocResults, "UNGEOLOCATABLE", "ungeolocatable login",
+		nil, due)
+	o.ungeolocResults = nil
+
+	// Report logins from countries the policy always alerts on, even if the
+	// locality is known or the principal is learning, unless a new geocenter
+	// was reported for it above
+	o.alertResults(o.policyResults, "HIGHRISKCOUNTRY",
+		"login from high-risk country", func(x objectResult) bool {
+			return alerted[o.branchOf(x.BranchID)]
+		}, required)
+	o.policyResults = nil
+
+	// Report logins from countries that are not allowed for the group the
+	// principal is a member of, regardless of whether the locality is known
+	// or the principal is learning
+	if o.group != nil {
+		o.alertResults(o.violationResults, "POLICYVIOLATION",
+			fmt.Sprintf("group %v policy violation", o.group.name), nil, required)
+	}
+	o.violationResults = nil
+
+	// Report logins from localities an analyst has confirmed hostile, even if
+	// the locality is known
+	o.alertResults(o.hostileResults, "HOSTILELOCATION",
+		"login from hostile locality", nil, required)
+	o.hostileResults = nil
+
 	// Now that new gencenters have been handled, apply a heuristic on the entire
 	// state to create any additional alerts required. Given a window of time, get
 	// a list of all authentication events that have occurred. If we see events
@@ -310,10 +906,13 @@ func (o *object) alertAnalyze() (err error) {
 	// window, also create an alert for this.
 	//
 	// The distance and time frame are sourced from the configuration file.
+	o.newBranches = alerted
 	_, err = o.analyzeUsageWithinWindow()
 	if err != nil {
 		panic(err)
 	}
+	o.newResultTimes = nil
+	o.newBranches = nil
 	return nil
 }
 
@@ -327,33 +926,102 @@ func (o *object) analyzeUsageWithinWindow() (ret []objectResult, err error) {
 		}
 	}()
 
-	dur, err := time.ParseDuration(cfg.Geo.MovementWindow)
+	dur, err := time.ParseDuration(o.movementWindow())
 	if err != nil {
 		panic(err)
 	}
-	cutoff := time.Now().UTC().Add(-1 * dur)
 
+	// Slide the window over the event timeline, evaluating each window that
+	// contains a newly merged event. This way the outcome does not depend on
+	// when the events are processed (e.g., if we are catching up on a
+	// backlog).
+	for _, end := range o.movementWindowEnds(dur) {
+		alertlist := o.analyzeWindow(end.Add(-1*dur), end)
+		if len(alertlist) == 0 {
+			continue
+		}
+		if o.shouldAlertMovement(alertlist) {
+			err = o.sendMovementAlert(alertlist)
+			if err != nil {
+				panic(err)
+			}
+		}
+		ret = alertlist
+	}
+
+	return ret, nil
+}
+
+// Return the end times of each movement window that should be evaluated, in
+// chronological order. These are windows that contain one of the results
+// added during this merge; if no results have been added the window ending at
+// the latest result is returned.
+func (o *object) movementWindowEnds(dur time.Duration) (ret []time.Time) {
+	anchors := o.newResultTimes
+	if len(anchors) == 0 {
+		var latest time.Time
+		for _, x := range o.Results {
+			if !x.Anchor && x.Timestamp.After(latest) {
+				latest = x.Timestamp
+			}
+		}
+		if latest.IsZero() {
+			return ret
+		}
+		anchors = []time.Time{latest}
+	}
+
+	ends := make(map[int64]time.Time)
+	for _, t := range anchors {
+		ends[t.UnixNano()] = t
+		// Windows ending at existing results within dur after the new
+		// result also contain it
+		for _, x := range o.Results {
+			if x.Timestamp.After(t) && !x.Timestamp.After(t.Add(dur)) {
+				ends[x.Timestamp.UnixNano()] = x.Timestamp
+			}
+		}
+	}
+	for _, v := range ends {
+		ret = append(ret, v)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Before(ret[j]) })
+	return ret
+}
+
+// Apply the movement heuristic to results in the window between start and
+// end; returns the list of results that are part of the alert if the window
+// violates the heuristic, otherwise returns an empty slice
+func (o *object) analyzeWindow(start time.Time, end time.Time) (ret objectResults) {
 	resl := make([]objectResult, 0)
 
-	// Build a slice of all the results we want to consider
+	// Build a slice of all the results we want to consider, results from
+	// noalert ranges never contribute to movement
 	for _, x := range o.Results {
-		if x.Timestamp.Before(cutoff) {
+		if x.Anchor || x.NoAlert || !x.located() {
+			continue
+		}
+		if x.Timestamp.Before(start) || x.Timestamp.After(end) {
 			continue
 		}
 		resl = append(resl, x)
 	}
 
+	// If a maximum travel speed is configured, compare consecutive events
+	// based on the speed required to move between them instead
+	if cfg.Geo.MaxSpeed != 0 {
+		mindist := float64(cfg.Geo.MinTravelDistance)
+		if mindist == 0 {
+			mindist = float64(o.collapseMaximum())
+		}
+		return analyzeVelocity(resl, mindist)
+	}
+
 	// Filter this list down further to the latest event in each geocenter within
 	// the window
 	geocenters := make(map[string]objectResult)
 	for _, x := range resl {
-		var bid string
-		if x.Collapsed {
-			bid = x.CollapseBranch
-		} else {
-			bid = x.BranchID
-		}
-
+		bid := x.branch()
 		compval, ok := geocenters[bid]
 		if !ok {
 			geocenters[bid] = x
@@ -372,8 +1040,7 @@ func (o *object) analyzeUsageWithinWindow() (ret []objectResult, err error) {
 			if k2 == k1 {
 				continue
 			}
-			dv := kmBetweenTwoPoints(v1.Latitude, v1.Longitude,
-				v2.Latitude, v2.Longitude)
+			dv := kmBetweenResults(v1, v2)
 			if dv > largest {
 				largest = dv
 			}
@@ -382,8 +1049,8 @@ func (o *object) analyzeUsageWithinWindow() (ret []objectResult, err error) {
 
 	// If the largest value is less than the movement distance, we are done
 	// here
-	if largest < float64(cfg.Geo.MovementDistance) {
-		return ret, nil
+	if largest < float64(o.movementDistance()) {
+		return ret
 	}
 
 	// Build the slice of geocenters we want to include in the alert
@@ -395,31 +1062,62 @@ func (o *object) analyzeUsageWithinWindow() (ret []objectResult, err error) {
 
 	// If the result list contains geocenters that are all localized to the
 	// same country, skip creating a movement alert for this.
-	tval := ""
-	variance := false
-	for _, v := range alertlist {
-		if tval == "" {
-			tval = v.Locality.Country
-			continue
-		}
-		if v.Locality.Country != tval {
-			variance = true
-			break
+	for _, v := range alertlist[1:] {
+		if !v.Locality.sameCountry(alertlist[0].Locality) {
+			return alertlist
 		}
 	}
-	if !variance {
-		ret = ret[:0]
-		return ret, nil
+	return ret
+}
+
+// Returns the speed in km/h required to travel dist km in elapsed; intervals
+// shorter than a minute are treated as a minute
+func impliedSpeed(dist float64, elapsed time.Duration) float64 {
+	if elapsed < time.Minute {
+		elapsed = time.Minute
 	}
+	return dist / elapsed.Hours()
+}
 
-	if !cfg.noSendAlert {
-		err = o.sendMovementAlert(alertlist)
-		if err != nil {
-			panic(err)
+// Compare consecutive events in resl by the speed implied by the distance and
+// time between them. Returns the events which form the path of any movement
+// exceeding the configured maximum speed, or an empty slice if none did.
+func analyzeVelocity(resl objectResults, mindist float64) (ret objectResults) {
+	sort.Sort(resl)
+
+	// Reduce the events to a list of stays in each locality, recording the
+	// first and last event seen in each
+	type stay struct {
+		first objectResult
+		last  objectResult
+	}
+	var stays []stay
+	for _, x := range resl {
+		if len(stays) != 0 && stays[len(stays)-1].last.branch() == x.branch() {
+			stays[len(stays)-1].last = x
+			continue
 		}
+		stays = append(stays, stay{first: x, last: x})
 	}
 
-	return alertlist, nil
+	for i := 1; i < len(stays); i++ {
+		from := stays[i-1].last
+		to := stays[i].first
+		dist := kmBetweenResults(from, to)
+		if dist < mindist {
+			continue
+		}
+		if impliedSpeed(dist, to.Timestamp.Sub(from.Timestamp)) <= float64(cfg.Geo.MaxSpeed) {
+			continue
+		}
+		// The event the path last arrived at is part of the same locality
+		// as from, even if from has since been collapsed into it
+		if len(ret) == 0 || ret[len(ret)-1].branch() != from.branch() {
+			ret = append(ret, from)
+		}
+		ret = append(ret, to)
+	}
+	return ret
 }
 
 // Specific to global state tracking
@@ -429,17 +1127,36 @@ type objectState struct {
 
 // Locality
 type Locality struct {
-	City    string `json:"city"`
-	Country string `json:"country"`
+	City            string `json:"city"`
+	Country         string `json:"country"`
+	CountryCode     string `json:"country_code,omitempty"`     // ISO 3166-1 country code
+	Subdivision     string `json:"subdivision,omitempty"`      // State or province
+	SubdivisionCode string `json:"subdivision_code,omitempty"` // ISO 3166-2 subdivision code
+	Continent       string `json:"continent,omitempty"`        // Continent code
+	Postal          string `json:"postal,omitempty"`           // Postal code
+	TimeZone        string `json:"time_zone,omitempty"`        // IANA time zone name
 }
 
 func (l *Locality) assemble() (string, error) {
 	if l.City == "" || l.Country == "" {
 		return "", fmt.Errorf("unable to assemble locality with empty values")
 	}
+	// If the city is unknown, the subdivision is more useful than nothing
+	if l.City == "Unknown" && l.Subdivision != "" {
+		return l.Subdivision + ", " + l.Country, nil
+	}
 	return l.City + ", " + l.Country, nil
 }
 
+// Returns true if both localities are in the same country; ISO codes are
+// compared if available since display names depend on the configured language
+func (l *Locality) sameCountry(l2 Locality) bool {
+	if l.CountryCode != "" && l2.CountryCode != "" {
+		return l.CountryCode == l2.CountryCode
+	}
+	return l.Country == l2.Country
+}
+
 // Principal geocenter
 type objectGeocenter struct {
 	Latitude  float64 `json:"latitude,omitempty"`
@@ -450,6 +1167,8 @@ type objectGeocenter struct {
 	AvgDist float64 `json:"avg_dist,omitempty"`
 	Weight  float64 `json:"weight"`
 
+	BranchID string `json:"branch_id,omitempty"` // Locality, for primary geocenters
+
 	// Compatibility with older state documents
 	OldLocality string `json:"locality,omitempty"`
 }
@@ -461,19 +1180,227 @@ type objectResult struct {
 	Latitude     float64  `json:"latitude"`
 	Longitude    float64  `json:"longitude"`
 	Locality     Locality `json:"locality_details"`
-	SourceIPV4   string   `json:"source_ipv4"`
-	Weight       float64  `json:"weight"`
-	Escalated    bool     `json:"escalated"`
+
+	AccuracyRadius float64 `json:"accuracy_radius,omitempty"` // MaxMind accuracy radius (km)
+	Site           string  `json:"site,omitempty"`            // Label of matching override
+	Ungeolocated   bool    `json:"ungeolocated,omitempty"`    // Country could not be determined
+	Anchor         bool    `json:"anchor,omitempty"`          // Seeded from home location directory
+
+	SourceIPV4 string  `json:"source_ipv4"`
+	ASN        uint    `json:"asn,omitempty"`
+	ASNOrg     string  `json:"asn_org,omitempty"`
+	Weight     float64 `json:"weight"`
+
+	AnonymousFlags []string `json:"anonymous_flags,omitempty"`
+
+	Escalated bool `json:"escalated"`
+	NoAlert   bool `json:"no_alert,omitempty"` // Matched a noalert exclusion
 
 	Timestamp time.Time `json:"timestamp"`
 
 	Collapsed      bool   `json:"collapsed"`
 	CollapseBranch string `json:"collapse_branch,omitempty"`
 
+	// Set if the result has been compacted; Timestamp is the last time the
+	// source address was seen, and Periods the number of events seen each
+	// day so they can expire individually
+	Count     int            `json:"count,omitempty"`
+	FirstSeen time.Time      `json:"first_seen,omitempty"`
+	Plugins   []string       `json:"plugins,omitempty"`
+	Periods   []resultPeriod `json:"periods,omitempty"`
+
+	newResult  bool   // Added during this merge
+	prevCenter bool   // Was a locality center before geoFlatten
+	prevBranch string // Locality the result was collapsed into before geoFlatten
+
 	// Compatibility with older state documents
 	OldLocality string `json:"locality,omitempty"`
 }
 
+// Length of the periods event counts are kept for in a compacted result
+const resultPeriodLength = 24 * time.Hour
+
+// Number of events a compacted result represents within a period
+type resultPeriod struct {
+	Start time.Time `json:"start"`
+	Count int       `json:"count"`
+}
+
+// Returns the number of events the result represents in each period. A result
+// compacted before periods were kept is treated as if all of its events were
+// seen at Timestamp.
+func (or *objectResult) periods() []resultPeriod {
+	if len(or.Periods) != 0 {
+		return or.Periods
+	}
+	return []resultPeriod{{Start: or.Timestamp.UTC().Truncate(resultPeriodLength),
+		Count: or.count()}}
+}
+
+// Remove the events in periods that ended before cutoff from a compacted
+// result; the events expire up to one period late
+func (or *objectResult) expirePeriods(cutoff time.Time) {
+	if len(or.Periods) == 0 {
+		return
+	}
+	var pl []resultPeriod
+	count := 0
+	for _, x := range or.Periods {
+		if !x.Start.Add(resultPeriodLength).After(cutoff) {
+			continue
+		}
+		pl = append(pl, x)
+		count += x.Count
+	}
+	if len(pl) == 0 {
+		return
+	}
+	or.Periods = pl
+	or.Count = count
+	if pl[0].Start.After(or.firstSeen()) {
+		or.FirstSeen = pl[0].Start
+	}
+}
+
+// Returns true if the result has been flagged as originating from anonymizer
+// type flag
+func (or *objectResult) isAnonymous(flag string) bool {
+	for _, x := range or.AnonymousFlags {
+		if x == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the number of events the result represents
+func (or *objectResult) count() int {
+	if or.Count == 0 {
+		return 1
+	}
+	return or.Count
+}
+
+// Returns the weight of the result used when calculating the geocenter. The
+// center of a locality is weighted by the number of events in the locality,
+// and each other result by the number of events it represents. If a compacted
+// result is the center, the other events it represents are added so the
+// weight is the same as it would have been without compaction.
+func (or *objectResult) geocenterWeight() float64 {
+	if or.Collapsed {
+		return or.Weight
+	}
+	return or.Weight + float64(or.count()-1)
+}
+
+// Returns the time the first event the result represents was seen
+func (or *objectResult) firstSeen() time.Time {
+	if or.FirstSeen.IsZero() {
+		return or.Timestamp
+	}
+	return or.FirstSeen
+}
+
+// Returns the plugins that created the events the result represents
+func (or *objectResult) plugins() []string {
+	if len(or.Plugins) == 0 {
+		return []string{or.SourcePlugin}
+	}
+	return or.Plugins
+}
+
+// Returns true if the results can be combined when compacting
+func (or *objectResult) compactsWith(r2 objectResult) bool {
+	return or.SourceIPV4 == r2.SourceIPV4 && or.Latitude == r2.Latitude &&
+		or.Longitude == r2.Longitude && or.ASN == r2.ASN &&
+		or.Ungeolocated == r2.Ungeolocated && !or.Anchor && !r2.Anchor
+}
+
+// Add the events represented by r2 to the result
+func (or *objectResult) compact(r2 objectResult) {
+	periods := make(map[int64]int)
+	for _, x := range or.periods() {
+		periods[x.Start.Unix()] += x.Count
+	}
+	for _, x := range r2.periods() {
+		periods[x.Start.Unix()] += x.Count
+	}
+	// Keep the ID of the result if it was the center of a locality, so the
+	// locality ID is retained
+	if or.Collapsed && !r2.Collapsed {
+		or.BranchID = r2.BranchID
+		or.Collapsed = false
+		or.CollapseBranch = ""
+	}
+	if r2.firstSeen().Before(or.firstSeen()) {
+		or.FirstSeen = r2.firstSeen()
+	} else {
+		or.FirstSeen = or.firstSeen()
+	}
+	if r2.Timestamp.After(or.Timestamp) {
+		or.Timestamp = r2.Timestamp
+	}
+	plugins := or.plugins()
+	for _, x := range r2.plugins() {
+		found := false
+		for _, y := range plugins {
+			if x == y {
+				found = true
+				break
+			}
+		}
+		if !found {
+			plugins = append(plugins, x)
+		}
+	}
+	or.Plugins = plugins
+	or.Periods = nil
+	for k, v := range periods {
+		or.Periods = append(or.Periods, resultPeriod{Start: time.Unix(k, 0).UTC(), Count: v})
+	}
+	sort.Slice(or.Periods, func(i, j int) bool {
+		return or.Periods[i].Start.Before(or.Periods[j].Start)
+	})
+	or.Count = or.count() + r2.count()
+	if r2.Escalated {
+		or.Escalated = true
+	}
+	or.NoAlert = or.NoAlert && r2.NoAlert
+}
+
+// Describe the source of the result for log messages
+func (or *objectResult) describe() (string, error) {
+	ret := or.SourceIPV4
+	if or.ASN != 0 {
+		ret += fmt.Sprintf(" AS%v %v", or.ASN, or.ASNOrg)
+	}
+	if len(or.AnonymousFlags) != 0 {
+		ret += " " + strings.Join(or.AnonymousFlags, ",")
+	}
+	if or.Ungeolocated {
+		return ret, nil
+	}
+	lval, err := or.Locality.assemble()
+	if err != nil {
+		return "", err
+	}
+	return ret + ", " + lval, nil
+}
+
+// Returns the branch the result is part of
+func (or *objectResult) branch() string {
+	if or.Collapsed {
+		return or.CollapseBranch
+	}
+	return or.BranchID
+}
+
+// Returns true if the result has a location that can be used in distance
+// calculations
+func (or *objectResult) located() bool {
+	return !(or.Latitude == 0 && or.Longitude == 0 && or.AccuracyRadius == 0)
+}
+
 // Define a new type for a slice of objectResults, and implement sort.Interface
 // here to facilitate sorting by timestamp where needed
 type objectResults []objectResult
@@ -495,10 +1422,21 @@ type alertDetailsMovement struct {
 	Principal  string         `json:"principal"`
 	Localities []objectResult `json:"localities"`
 	Severity   int            `json:"severity"`
+
+	Speed    float64 `json:"speed"`    // Fastest implied speed between localities (km/h)
+	Distance float64 `json:"distance"` // Distance for the fastest movement (km)
+	Elapsed  string  `json:"elapsed"`  // Time taken for the fastest movement
+	Window   string  `json:"window"`   // Movement window applied to the principal
+
+	TravelNotice int  `json:"travel_notice,omitempty"` // ID of travel notice covering movement
+	Learning     bool `json:"learning,omitempty"`      // Principal is in learning period
 }
 
 func (ad *alertDetailsMovement) makeSummary() (string, error) {
 	ret := fmt.Sprintf("%v MOVEMENT window violation ", ad.Principal)
+	if cfg.Geo.MaxSpeed != 0 {
+		ret = fmt.Sprintf("%v MOVEMENT impossible travel ", ad.Principal)
+	}
 	iv := 0
 	if len(ad.Localities) > 3 {
 		iv = len(ad.Localities) - 3
@@ -512,11 +1450,98 @@ func (ad *alertDetailsMovement) makeSummary() (string, error) {
 		if err != nil {
 			return "", err
 		}
-		ret += "(" + lval + ")"
+		ret += "(" + lval
+		if isImpreciseRadius(ad.Localities[i].AccuracyRadius) {
+			ret += fmt.Sprintf(" accuracy %.0f km", ad.Localities[i].AccuracyRadius)
+		}
+		ret += ")"
 		more = true
 	}
-	ret += fmt.Sprintf(" within %v window", cfg.Geo.MovementWindow)
-	return ret, nil
+	if cfg.Geo.MaxSpeed != 0 {
+		ret += fmt.Sprintf(" %.0f km in %v (%.0f km/h)", ad.Distance,
+			ad.Elapsed, ad.Speed)
+		if ad.highRisk() {
+			ret += " [high-risk country]"
+		}
+		return ret + ad.tagSummary(), nil
+	}
+	window := ad.Window
+	if window == "" {
+		window = cfg.Geo.MovementWindow
+	}
+	ret += fmt.Sprintf(" within %v window", window)
+	if ad.highRisk() {
+		ret += " [high-risk country]"
+	}
+	return ret + ad.tagSummary(), nil
+}
+
+func (ad *alertDetailsMovement) tagSummary() (ret string) {
+	if ad.Learning {
+		ret += " [learning]"
+	}
+	if ad.TravelNotice != 0 {
+		ret += fmt.Sprintf(" [travel notice %v]", ad.TravelNotice)
+	}
+	return ret
+}
+
+// Note an active travel notice covering the movement, downgrading the alert
+// if configured. The movement is covered if a locality in it is a destination
+// of the notice, and every other locality is either a destination or was
+// known for the principal before this merge.
+func (ad *alertDetailsMovement) addTravel(o *object) {
+	var tn *travelNotice
+	for _, x := range ad.Localities {
+		n := travelNotices.find(ad.Principal, x.Locality, x.Timestamp)
+		if n != nil {
+			if tn == nil {
+				tn = n
+			}
+			continue
+		}
+		if o.newBranches[o.branchOf(x.BranchID)] {
+			return
+		}
+	}
+	if tn == nil {
+		return
+	}
+	ad.TravelNotice = tn.ID
+	if travelDowngraded() {
+		ad.Severity = 0
+	}
+}
+
+// Returns the country policy with the largest severity adjustment that
+// applies to the localities in the alert, or nil if none apply
+func (ad *alertDetailsMovement) countryPolicy() (ret *countryPolicy) {
+	for _, x := range ad.Localities {
+		cp := findCountryPolicy(x.Locality)
+		if cp == nil {
+			continue
+		}
+		if ret == nil || cp.adjustment > ret.adjustment {
+			ret = cp
+		}
+	}
+	return ret
+}
+
+// Returns true if the alert involves a high-risk country
+func (ad *alertDetailsMovement) highRisk() bool {
+	cp := ad.countryPolicy()
+	return cp != nil && (cp.adjustment > 0 || cp.alwaysAlert)
+}
+
+func (ad *alertDetailsMovement) calculateSeverity() {
+	ad.Severity = 3
+	if cp := ad.countryPolicy(); cp != nil {
+		ad.Severity += cp.adjustment
+	}
+	if ad.Severity < 0 {
+		ad.Severity = 0
+	}
 }
 
 // Describes an individual alert for a branch
@@ -526,17 +1551,66 @@ type alertDetailsBranch struct {
 	Locality        Locality  `json:"locality_details"`
 	Latitude        float64   `json:"latitude"`
 	Longitude       float64   `json:"longitude"`
+	AccuracyRadius  float64   `json:"accuracy_radius"`
+	Site            string    `json:"site,omitempty"`
 	Timestamp       time.Time `json:"event_time"`
 	WeightDeviation float64   `json:"weight_deviation"`
 	SourceIPV4      string    `json:"source_ipv4"`
+	ASN             uint      `json:"asn,omitempty"`
+	ASNOrg          string    `json:"asn_org,omitempty"`
+	AnonymousFlags  []string  `json:"anonymous_flags,omitempty"`
 	Informer        string    `json:"informer"`
 	Severity        int       `json:"severity"`
+	Learning        bool      `json:"learning,omitempty"` // Principal is in learning period
+	Group           string    `json:"group,omitempty"`    // Group the principal is a member of
+	CountryKnown    bool      `json:"country_known"`      // Country seen before for principal
+	CountryLastSeen time.Time `json:"country_last_seen"`  // Last time country was seen
+
+	GeocenterDistance float64  `json:"geocenter_distance"`         // Distance from nearest geocenter
+	GeocenterLocality Locality `json:"geocenter_locality_details"` // Locality of nearest geocenter
+
+	LocalTime   string `json:"local_time"`   // Event time in usual timezone of principal
+	UnusualHour bool   `json:"unusual_hour"` // Hour is unusual for the principal
+	UnusualDay  bool   `json:"unusual_day"`  // Weekday is unusual for the principal
+
+	TravelNotice int `json:"travel_notice,omitempty"` // ID of travel notice covering locality
+
+	BranchID string `json:"branch_id,omitempty"` // Branch the alert was created for
+	AlertID  string `json:"alert_id,omitempty"`  // Identifies the alert for analyst feedback
 
 	PrevLocality  Locality  `json:"prev_locality_details"`
 	PrevLatitude  float64   `json:"prev_latitude"`
 	PrevLongitude float64   `json:"prev_longitude"`
+	PrevAccuracy  float64   `json:"prev_accuracy_radius"`
 	PrevTimestamp time.Time `json:"prev_timestamp"`
 	PrevDistance  float64   `json:"prev_distance"`
+
+	priorLocalities bool // Principal has other localities, history or anchors
+}
+
+// Populate the alert details using result x from object o
+func (ad *alertDetailsBranch) fromResult(o *object, x objectResult) {
+	ad.Locality = x.Locality
+	ad.Latitude = x.Latitude
+	ad.Longitude = x.Longitude
+	ad.AccuracyRadius = x.AccuracyRadius
+	ad.Site = x.Site
+	ad.SourceIPV4 = x.SourceIPV4
+	ad.ASN = x.ASN
+	ad.ASNOrg = x.ASNOrg
+	ad.AnonymousFlags = x.AnonymousFlags
+	ad.Informer = x.SourcePlugin
+	ad.Principal = o.ObjectIDString
+	ad.WeightDeviation = o.WeightDeviation
+	ad.Timestamp = x.Timestamp
+	if o.group != nil {
+		ad.Group = o.group.name
+	}
+	if gc := o.nearestGeocenter(x); gc != nil {
+		ad.GeocenterDistance = kmBetweenTwoPoints(ad.Latitude, ad.Longitude,
+			gc.Latitude, gc.Longitude)
+		ad.GeocenterLocality = gc.Locality
+	}
 }
 
 func (ad *alertDetailsBranch) makeSummary() (string, error) {
@@ -544,12 +1618,70 @@ func (ad *alertDetailsBranch) makeSummary() (string, error) {
 	if err != nil {
 		return "", err
 	}
-	category := "NEWLOCATION"
-	if ad.Severity == 2 {
-		category = "NEWCOUNTRY"
+	category := ad.Category
+	if category == "" {
+		category = "NEWLOCATION"
+		if ad.Severity == 2 {
+			category = "NEWCOUNTRY"
+		}
 	}
 	ret := fmt.Sprintf("%v %v %v access from %v (%v)", ad.Principal,
 		category, lval, ad.SourceIPV4, ad.Informer)
+	if ad.ASN != 0 {
+		ret += fmt.Sprintf(" [AS%v %v]", ad.ASN, ad.ASNOrg)
+	}
+	if isImpreciseRadius(ad.AccuracyRadius) {
+		ret += fmt.Sprintf(" [accuracy:%.0f km]", ad.AccuracyRadius)
+	}
+	if ad.countryStale() {
+		ret += fmt.Sprintf(" [country last seen %v]",
+			ad.CountryLastSeen.Format("2006-01-02"))
+	}
+	if ad.distantFromGeocenter() {
+		// The principal geocenter used for older state documents has no
+		// locality
+		gval, err := ad.GeocenterLocality.assemble()
+		if err != nil {
+			ret += fmt.Sprintf(" [geocenter:%.0f km]", ad.GeocenterDistance)
+		} else {
+			ret += fmt.Sprintf(" [geocenter:%.0f km from %v]", ad.GeocenterDistance, gval)
+		}
+	}
+	if ad.UnusualHour || ad.UnusualDay {
+		ret += fmt.Sprintf(" [unusual time:%v]", ad.LocalTime)
+	}
+	if ad.Learning {
+		ret += " [learning]"
+	}
+	if ad.TravelNotice != 0 {
+		ret += fmt.Sprintf(" [travel notice %v]", ad.TravelNotice)
+	}
+	if len(ad.AnonymousFlags) != 0 {
+		ret += fmt.Sprintf(" [anonymizer:%v]", strings.Join(ad.AnonymousFlags, ","))
+	}
+	if cp := findCountryPolicy(ad.Locality); cp != nil && (cp.adjustment > 0 || cp.alwaysAlert) {
+		ret += " [high-risk country]"
+	}
+	switch category {
+	case "NEWASN":
+		ret += ", network not previously seen within known locality"
+		return ret, nil
+	case "UNGEOLOCATABLE":
+		ret += ", source address could not be geolocated"
+		return ret, nil
+	case "ANONYMIZER":
+		ret += ", anonymizer used within known locality"
+		return ret, nil
+	case "HIGHRISKCOUNTRY":
+		ret += ", login from high-risk country"
+		return ret, nil
+	case "POLICYVIOLATION":
+		ret += fmt.Sprintf(", country not allowed for group %v", ad.Group)
+		return ret, nil
+	case "HOSTILELOCATION":
+		ret += ", locality confirmed hostile by analyst"
+		return ret, nil
+	}
 	ret += fmt.Sprintf(" [deviation:%v]", ad.WeightDeviation)
 	if ad.PrevLocality.Country != "" && ad.PrevLocality.City != "" {
 		dur := ad.Timestamp.Sub(ad.PrevTimestamp)
@@ -564,8 +1696,12 @@ func (ad *alertDetailsBranch) makeSummary() (string, error) {
 		if err != nil {
 			return "", err
 		}
-		ret += fmt.Sprintf(" last activity was from %v (%.0f km away) %v", lval2,
-			ad.PrevDistance, sstr)
+		dstr := fmt.Sprintf("%.0f km away", ad.PrevDistance)
+		if isImpreciseRadius(ad.PrevAccuracy) {
+			dstr += fmt.Sprintf(", accuracy %.0f km", ad.PrevAccuracy)
+		}
+		ret += fmt.Sprintf(" last activity was from %v (%v) %v", lval2,
+			dstr, sstr)
 	} else {
 		ret += ", no previous locations stored in window"
 	}
@@ -578,17 +1714,141 @@ func (ad *alertDetailsBranch) calculateSeverity() error {
 	ad.Severity = 1
 	ad.Category = "NEWLOCATION"
 
-	// If the previous country is a different country from this new alert,
-	// increase the severity.
-	if ad.PrevLocality.Country != "" {
-		if ad.PrevLocality.Country != ad.Locality.Country {
-			ad.Category = "NEWCOUNTRY"
-			ad.Severity++
-		}
+	// If the country has never been seen for the principal, increase the
+	// severity. If the previous event is from the same country, the country
+	// is known regardless of the history available in the alert. The first
+	// country seen for a principal with no previous event, history or anchors
+	// is not treated as new.
+	known := ad.CountryKnown || (ad.PrevLocality.Country != "" &&
+		ad.PrevLocality.sameCountry(ad.Locality))
+	prior := ad.PrevLocality.Country != "" || ad.priorLocalities
+	if ad.Locality.Country != "" && !known && prior {
+		ad.Category = "NEWCOUNTRY"
+		ad.Severity++
+	}
+	// A known country that has not been seen for a long time is treated as
+	// more suspicious than one the principal is regularly in
+	if ad.countryStale() {
+		ad.Severity++
 	}
+	// As is a location far from where the principal usually is
+	if ad.distantFromGeocenter() {
+		ad.Severity++
+	}
+	// And logins at times the principal is not usually active
+	if ad.UnusualHour {
+		ad.Severity++
+	}
+	if ad.UnusualDay {
+		ad.Severity++
+	}
+	ad.adjustSeverity()
 	return nil
 }
 
+// Mark the alert as created during the learning period for the principal,
+// which uses a dedicated informational severity
+func (ad *alertDetailsBranch) setLearning() {
+	ad.Learning = true
+	ad.Severity = 0
+}
+
+// Note an active travel notice covering the locality, downgrading the alert
+// if configured
+func (ad *alertDetailsBranch) addTravel() {
+	tn := travelNotices.find(ad.Principal, ad.Locality, ad.Timestamp)
+	if tn == nil {
+		return
+	}
+	ad.TravelNotice = tn.ID
+	if travelDowngraded() {
+		ad.Severity = 0
+	}
+}
+
+// Apply adjustments to the severity of the alert that are independent of the
+// alert category
+func (ad *alertDetailsBranch) adjustSeverity() {
+	// Access through an anonymizing service is more suspicious than a
+	// regular new location
+	if len(ad.AnonymousFlags) != 0 {
+		ad.Severity++
+	}
+	if cp := findCountryPolicy(ad.Locality); cp != nil {
+		ad.Severity += cp.adjustment
+		if ad.Severity < 0 {
+			ad.Severity = 0
+		}
+	}
+}
+
+// Returns true if the country is known for the principal, but has not been
+// seen within the configured country recency period
+func (ad *alertDetailsBranch) countryStale() bool {
+	if cfg.Geo.CountryRecency == "" || !ad.CountryKnown || ad.CountryLastSeen.IsZero() {
+		return false
+	}
+	dur, err := time.ParseDuration(cfg.Geo.CountryRecency)
+	if err != nil {
+		panic(err)
+	}
+	return ad.Timestamp.Sub(ad.CountryLastSeen) > dur
+}
+
+// Returns true if the alert is further than the configured distance from the
+// geocenter of the principal
+func (ad *alertDetailsBranch) distantFromGeocenter() bool {
+	if cfg.Geo.GeocenterDistance == 0 {
+		return false
+	}
+	return ad.GeocenterDistance > float64(cfg.Geo.GeocenterDistance)
+}
+
+// Compare the time of the alert to the login time profile of the principal,
+// if the unusual time detector is enabled
+func (ad *alertDetailsBranch) addProfile(o *object) {
+	t := ad.Timestamp.In(o.usualLocation())
+	ad.LocalTime = t.Format("Mon 15:04 MST")
+	if !cfg.Geo.UnusualTime {
+		return
+	}
+	ad.UnusualHour = o.Profile.unusualHour(t)
+	ad.UnusualDay = o.Profile.unusualDay(t)
+}
+
+// Add details about the history of the principal to the alert; this
+// considers both the results stored for the principal outside of the alert
+// branch, and the long-term history summary
+func (ad *alertDetailsBranch) addHistory(o *object, branchID string) {
+	if len(o.History.Countries) != 0 {
+		ad.priorLocalities = true
+	}
+	for _, x := range o.Results {
+		if x.BranchID == branchID || x.CollapseBranch == branchID {
+			continue
+		}
+		if !x.located() {
+			continue
+		}
+		ad.priorLocalities = true
+		if !x.Locality.sameCountry(ad.Locality) {
+			continue
+		}
+		ad.CountryKnown = true
+		// Anchors have no timestamp, but still indicate the country is
+		// known
+		if x.Timestamp.After(ad.CountryLastSeen) {
+			ad.CountryLastSeen = x.Timestamp
+		}
+	}
+	if hc := o.History.findCountry(ad.Locality); hc != nil {
+		ad.CountryKnown = true
+		if hc.LastSeen.After(ad.CountryLastSeen) {
+			ad.CountryLastSeen = hc.LastSeen
+		}
+	}
+}
+
 // Locate the event in this object that is unrelated to the alert event,
 // and is closest to it based on the timestamp
 func (ad *alertDetailsBranch) addPreviousEvent(o *object, branchID string) (err error) {
@@ -606,6 +1866,9 @@ func (ad *alertDetailsBranch) addPreviousEvent(o *object, branchID string) (err
 		} else if o.Results[i].CollapseBranch == branchID {
 			continue
 		}
+		if !o.Results[i].located() || o.Results[i].Anchor {
+			continue
+		}
 		if latest.Before(o.Results[i].Timestamp) {
 			res = &o.Results[i]
 		}
@@ -617,6 +1880,7 @@ func (ad *alertDetailsBranch) addPreviousEvent(o *object, branchID string) (err
 	ad.PrevLocality = res.Locality
 	ad.PrevLatitude = res.Latitude
 	ad.PrevLongitude = res.Longitude
+	ad.PrevAccuracy = res.AccuracyRadius
 	ad.PrevTimestamp = res.Timestamp
 	ad.PrevDistance = kmBetweenTwoPoints(ad.Latitude, ad.Longitude,
 		ad.PrevLatitude, ad.PrevLongitude)
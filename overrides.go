@@ -8,59 +8,172 @@
 package main
 
 import (
-	"bufio"
+	"encoding/csv"
 	"fmt"
+	"io"
+	"net"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 type override struct {
-	cidr      string
-	city      string
-	country   string
-	latitude  float64
-	longitude float64
+	cidr        string
+	subnet      *net.IPNet
+	city        string
+	country     string
+	latitude    float64
+	longitude   float64
+	label       string    // Optional site label
+	expires     time.Time // Optional expiry, zero value never expires
+	countryCode string    // Optional ISO 3166-1 country code
+}
+
+// Protects cfg.overrides, which can be replaced if the overrides file is
+// reloaded
+var overridesLock sync.RWMutex
+
+func (o *override) expired() bool {
+	if o.expires.IsZero() {
+		return false
+	}
+	return time.Now().UTC().After(o.expires)
+}
+
+// Parse an expiry value from the overrides file, which can either be a date
+// or an RFC3339 timestamp
+func parseOverrideExpiry(s string) (time.Time, error) {
+	t, err := time.Parse("2006-01-02", s)
+	if err == nil {
+		// A date expires at the end of the day
+		return t.Add(24 * time.Hour), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// Create an override from a single record in the overrides file
+func parseOverride(record []string) (ret override, err error) {
+	if len(record) < 5 || len(record) > 8 {
+		return ret, fmt.Errorf("override must have between 5 and 8 elements: %v", record)
+	}
+	for i := range record {
+		record[i] = strings.TrimSpace(record[i])
+	}
+	ret.cidr = record[0]
+	_, ret.subnet, err = net.ParseCIDR(ret.cidr)
+	if err != nil {
+		return ret, err
+	}
+	ret.city = record[1]
+	ret.country = record[2]
+	if ret.city == "" || ret.country == "" {
+		return ret, fmt.Errorf("override for %v must have a city and country", ret.cidr)
+	}
+	ret.latitude, err = strconv.ParseFloat(record[3], 64)
+	if err != nil {
+		return ret, err
+	}
+	if ret.latitude < -90 || ret.latitude > 90 {
+		return ret, fmt.Errorf("override for %v has invalid latitude", ret.cidr)
+	}
+	ret.longitude, err = strconv.ParseFloat(record[4], 64)
+	if err != nil {
+		return ret, err
+	}
+	if ret.longitude < -180 || ret.longitude > 180 {
+		return ret, fmt.Errorf("override for %v has invalid longitude", ret.cidr)
+	}
+	if len(record) >= 6 {
+		ret.label = record[5]
+	}
+	if len(record) >= 7 && record[6] != "" {
+		ret.expires, err = parseOverrideExpiry(record[6])
+		if err != nil {
+			return ret, err
+		}
+	}
+	if len(record) == 8 && record[7] != "" {
+		ret.countryCode = strings.ToUpper(record[7])
+		if len(ret.countryCode) != 2 {
+			return ret, fmt.Errorf("override for %v has invalid country code", ret.cidr)
+		}
+	}
+	return ret, nil
 }
 
 func readOverrides(path string) (overrides []override, err error) {
 	file, err := os.Open(path)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error opening file: %v\n", err)
 		return nil, err
 	}
 	defer file.Close()
 
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line_contents := scanner.Text()
-		if strings.HasPrefix(line_contents, "#") {
-			// The line is a comment, so we'll skip it
-			continue
+	reader := csv.NewReader(file)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
 		}
-
-		elements := strings.Split(line_contents, ",")
-		elements_len := len(elements)
-		if elements_len != 5 {
-			return nil, fmt.Errorf("Line must have 5 comma separated elements: %v", line_contents)
+		if err != nil {
+			return nil, err
 		}
-
-		cidr := elements[0]
-		city := elements[1]
-		country := elements[2]
-		latitude, lat_err := strconv.ParseFloat(elements[3], 64)
-		if lat_err != nil {
-			fmt.Fprintf(os.Stderr, "Error converting latitude: %v\n", lat_err)
-			return nil, lat_err
+		ovr, err := parseOverride(record)
+		if err != nil {
+			line, _ := reader.FieldPos(0)
+			return nil, fmt.Errorf("%v line %v: %v", path, line, err)
 		}
-		longitude, long_err := strconv.ParseFloat(elements[4], 64)
-		if long_err != nil {
-			fmt.Fprintf(os.Stderr, "Error converting longitude: %v\n", long_err)
-			return nil, long_err
-		}
-
-		overrides = append(overrides, override{cidr, city, country, latitude, longitude})
+		overrides = append(overrides, ovr)
 	}
 
 	return overrides, nil
 }
+
+// Read the overrides file again, replacing the overrides currently in use;
+// if the file cannot be read the existing overrides are kept
+func reloadOverrides() error {
+	overrides, err := readOverrides(cfg.overridesPath)
+	if err != nil {
+		return err
+	}
+	overridesLock.Lock()
+	cfg.overrides = overrides
+	overridesLock.Unlock()
+	logf("reloaded %v overrides", len(overrides))
+	return nil
+}
+
+// Return the override entry that applies to ip, or nil if no override
+// matches the address. If more than one override matches, the one with the
+// longest prefix is used.
+func findOverride(ip net.IP) *override {
+	overridesLock.RLock()
+	defer overridesLock.RUnlock()
+
+	var ret *override
+	retlen := -1
+	for i := range cfg.overrides {
+		if cfg.overrides[i].expired() {
+			continue
+		}
+		if !cfg.overrides[i].subnet.Contains(ip) {
+			continue
+		}
+		plen, _ := cfg.overrides[i].subnet.Mask.Size()
+		if plen > retlen {
+			ret = &cfg.overrides[i]
+			retlen = plen
+		}
+	}
+	if ret == nil {
+		return nil
+	}
+	// Return a copy, the override list could be replaced once the lock
+	// is released
+	ovr := *ret
+	return &ovr
+}
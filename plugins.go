@@ -51,6 +51,8 @@ type eventResult struct {
 	SourceIPV4 string    `json:"source_ipv4"` // Source IPV4 for authentication
 	Valid      bool      `json:"valid"`       // True if entry was parsed correctly by plugin
 	Name       string    `json:"name"`        // Name of plugin that created result
+
+	noAlert bool // Matched an exclusion that keeps the event but suppresses alerts
 }
 
 func (e *eventResult) validate() error {
@@ -78,21 +80,26 @@ func (e *eventResult) validate() error {
 }
 
 func (e *eventResult) invalidateSourceIPV4() error {
-	var blackList = []*net.IPNet{
-		&net.IPNet{IP: net.IPv4(0, 0, 0, 0), Mask: net.IPv4Mask(255, 255, 255, 255)},
-		&net.IPNet{IP: net.IPv4(10, 0, 0, 0), Mask: net.IPv4Mask(255, 0, 0, 0)},
-		&net.IPNet{IP: net.IPv4(172, 16, 0, 0), Mask: net.IPv4Mask(255, 240, 0, 0)},
-		&net.IPNet{IP: net.IPv4(192, 168, 0, 0), Mask: net.IPv4Mask(255, 255, 0, 0)},
-	}
 	ip := net.ParseIP(e.SourceIPV4)
 	if ip == nil {
 		return fmt.Errorf("source_ipv4 value %v is invalid", e.SourceIPV4)
 	}
-	for _, x := range blackList {
-		if x.Contains(ip) {
-			e.Valid = false
-			return nil
-		}
+	// If the address is claimed by an override it maps to a known site (for
+	// example a VPN concentrator or office NAT range), so keep it even if it
+	// would otherwise be excluded
+	if findOverride(ip) != nil {
+		return nil
+	}
+	excl := findExclusion(ip)
+	if excl == nil {
+		return nil
+	}
+	exclCounters.increment(excl.label)
+	switch excl.action {
+	case exclusionDrop:
+		e.Valid = false
+	case exclusionNoAlert:
+		e.noAlert = true
 	}
 	return nil
 }
@@ -0,0 +1,114 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor:
+// - agent agent@local
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+const (
+	profileMinEvents = 20   // Events needed before the profile is used
+	profileMinShare  = 0.05 // Share of events below which a time is unusual
+)
+
+// Histogram of the times a principal logs in, by hour of the week in UTC.
+// The histogram is converted to the usual timezone of the principal when it
+// is queried, so events recorded while the principal was usually in another
+// timezone are still comparable.
+type objectProfile struct {
+	Week [168]int `json:"week"`
+
+	// Compatibility with older state documents, which recorded the hours in
+	// the usual timezone at the time
+	OldHours []int `json:"hours,omitempty"`
+}
+
+// Return the number of events in the profile
+func (p *objectProfile) total() (ret int) {
+	for _, x := range p.Week {
+		ret += x
+	}
+	return ret
+}
+
+// Add an event occurring at t to the profile
+func (p *objectProfile) add(t time.Time) {
+	t = t.UTC()
+	p.Week[int(t.Weekday())*24+t.Hour()]++
+}
+
+// Return the histogram of hours and weekdays in the timezone of t; offsets
+// that are not whole hours are rounded to the nearest hour
+func (p *objectProfile) local(t time.Time) (hours [24]int, days [7]int) {
+	_, off := t.Zone()
+	shift := int(math.Round(float64(off) / 3600))
+	for i, n := range p.Week {
+		j := ((i+shift)%168 + 168) % 168
+		hours[j%24] += n
+		days[j/24] += n
+	}
+	return hours, days
+}
+
+// Returns true if the hour of t is unusual for the principal; an hour is
+// unusual if few events have been seen within an hour of it
+func (p *objectProfile) unusualHour(t time.Time) bool {
+	total := p.total()
+	if total < profileMinEvents {
+		return false
+	}
+	hours, _ := p.local(t)
+	h := t.Hour()
+	n := hours[(h+23)%24] + hours[h] + hours[(h+1)%24]
+	return float64(n)/float64(total) < profileMinShare
+}
+
+// Returns true if the weekday of t is unusual for the principal
+func (p *objectProfile) unusualDay(t time.Time) bool {
+	total := p.total()
+	if total < profileMinEvents {
+		return false
+	}
+	_, days := p.local(t)
+	return float64(days[t.Weekday()])/float64(total) < profileMinShare
+}
+
+// Return the usual timezone of the principal. This is the timezone of the
+// primary geocenter with the most events if MaxMind provided one, otherwise
+// it is estimated from the longitude of the geocenter.
+func (o *object) usualLocation() *time.Location {
+	var lon float64
+	if len(o.Geocenters) != 0 {
+		if tz := o.Geocenters[0].Locality.TimeZone; tz != "" {
+			loc, err := time.LoadLocation(tz)
+			if err == nil {
+				return loc
+			}
+		}
+		lon = o.Geocenters[0].Longitude
+	} else if o.Geocenter.Weight != 0 {
+		lon = o.Geocenter.Longitude
+	} else {
+		return time.UTC
+	}
+	offset := int(math.Round(lon / 15))
+	return time.FixedZone(fmt.Sprintf("UTC%+d", offset), offset*3600)
+}
+
+// Add the results from this merge to the profile, ignoring results from
+// noalert ranges
+func (o *object) updateProfile() {
+	for _, x := range o.historyResults {
+		if x.NoAlert {
+			continue
+		}
+		o.Profile.add(x.Timestamp)
+	}
+}
@@ -0,0 +1,224 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor:
+// - agent agent@local
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Window used for shared source address detection if not configured
+const defaultSharedIPWindow = "1h"
+
+// Index of source addresses to the principals that have recently
+// authenticated from them, used to identify a single address being used
+// with many principals
+type sharedIPIndex struct {
+	sync.Mutex
+	entries map[string]map[string]time.Time // Address -> principal -> event time
+	alerted map[string]time.Time            // Address -> event time of last alert
+	latest  time.Time                       // Latest event time seen, not after the merge time
+}
+
+var sharedIPs sharedIPIndex
+
+func (s *sharedIPIndex) reset() {
+	s.Lock()
+	s.entries = nil
+	s.alerted = nil
+	s.latest = time.Time{}
+	s.Unlock()
+}
+
+// Returns true if the event should not be considered for shared source
+// address detection; this applies to known shared egress ranges, addresses
+// with an override (e.g., office NAT) and excluded addresses
+func sharedIPExempt(e eventResult) bool {
+	if !e.Valid || e.noAlert {
+		return true
+	}
+	ip := net.ParseIP(e.SourceIPV4)
+	if ip == nil {
+		return true
+	}
+	for _, x := range cfg.sharedEgress {
+		if x.Contains(ip) {
+			return true
+		}
+	}
+	return findOverride(ip) != nil
+}
+
+// Add the events to the index, and return details for any addresses that
+// have been used by at least the threshold number of principals within the
+// window. Only one alert is returned for an address within the window. Event
+// times after now (the merge time) are treated as now, so an event with an
+// incorrect future timestamp can't expire the rest of the index.
+func (s *sharedIPIndex) update(events []eventResult, now time.Time) (ret []alertDetailsSharedIP, err error) {
+	if cfg.Geo.SharedIPThreshold == 0 {
+		return nil, nil
+	}
+	window := cfg.Geo.SharedIPWindow
+	if window == "" {
+		window = defaultSharedIPWindow
+	}
+	dur, err := time.ParseDuration(window)
+	if err != nil {
+		return nil, err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	if s.entries == nil {
+		s.entries = make(map[string]map[string]time.Time)
+		s.alerted = make(map[string]time.Time)
+	}
+	updated := make(map[string]bool)
+	for _, e := range events {
+		if sharedIPExempt(e) {
+			continue
+		}
+		p, ok := s.entries[e.SourceIPV4]
+		if !ok {
+			p = make(map[string]time.Time)
+			s.entries[e.SourceIPV4] = p
+		}
+		t := e.Timestamp
+		if t.After(now) {
+			t = now
+		}
+		if t.After(p[e.Principal]) {
+			p[e.Principal] = t
+		}
+		if t.After(s.latest) {
+			s.latest = t
+		}
+		updated[e.SourceIPV4] = true
+	}
+
+	// Remove principals that are no longer within the window
+	cutoff := s.latest.Add(-1 * dur)
+	for ip, p := range s.entries {
+		for k, v := range p {
+			if v.Before(cutoff) {
+				delete(p, k)
+			}
+		}
+		if len(p) == 0 {
+			delete(s.entries, ip)
+		}
+	}
+	for ip, v := range s.alerted {
+		if v.Before(cutoff) {
+			delete(s.alerted, ip)
+		}
+	}
+
+	var ips []string
+	for ip := range updated {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+	for _, ip := range ips {
+		p := s.entries[ip]
+		if len(p) < cfg.Geo.SharedIPThreshold {
+			continue
+		}
+		if _, ok := s.alerted[ip]; ok {
+			continue
+		}
+		ad := alertDetailsSharedIP{SourceIPV4: ip, Window: window, Severity: 3}
+		var last time.Time
+		for k, v := range p {
+			ad.Principals = append(ad.Principals, k)
+			if v.After(last) {
+				last = v
+			}
+		}
+		sort.Strings(ad.Principals)
+		ad.Timestamp = last
+		s.alerted[ip] = last
+		ret = append(ret, ad)
+	}
+	return ret, nil
+}
+
+// Update the shared source address index with the events, and send alerts
+// for any addresses that cross the threshold
+func analyzeSharedIPs(events []eventResult) error {
+	alerts, err := sharedIPs.update(events, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	for _, x := range alerts {
+		logf("[NOTICE] source address %v used by %v principals", x.SourceIPV4,
+			len(x.Principals))
+		if cfg.noSendAlert {
+			continue
+		}
+		err = sendAlert(&x)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Describes an alert for a source address used by many principals
+type alertDetailsSharedIP struct {
+	SourceIPV4 string    `json:"source_ipv4"`
+	Principals []string  `json:"principals"`
+	Window     string    `json:"window"`
+	Timestamp  time.Time `json:"event_time"`
+	Severity   int       `json:"severity"`
+}
+
+func (ad *alertDetailsSharedIP) makeSummary() (string, error) {
+	plist := ad.Principals
+	more := ""
+	if len(plist) > 10 {
+		more = fmt.Sprintf(" and %v more", len(plist)-10)
+		plist = plist[:10]
+	}
+	return fmt.Sprintf("%v SHAREDIP used by %v principals within %v window (%v%v)",
+		ad.SourceIPV4, len(ad.Principals), ad.Window, strings.Join(plist, ", "),
+		more), nil
+}
+
+// Read a file containing known shared egress ranges, one CIDR per line
+func readSharedEgress(path string) (ret []*net.IPNet, err error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	scnr := bufio.NewScanner(fd)
+	for scnr.Scan() {
+		buf := strings.TrimSpace(scnr.Text())
+		if buf == "" || strings.HasPrefix(buf, "#") {
+			continue
+		}
+		_, subnet, err := net.ParseCIDR(buf)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, subnet)
+	}
+	err = scnr.Err()
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
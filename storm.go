@@ -0,0 +1,295 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor:
+// - agent agent@local
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Window new geocenters are correlated over, and individual alerts are
+// suppressed for after a location shift, if not configured
+const defaultStormWindow = "1h"
+
+// Time held alerts are kept before being sent individually if not configured
+const defaultStormGrace = "5m"
+
+// A new geocenter for a principal, held for the grace period so it can be
+// correlated with new geocenters for other principals
+type stormCandidate struct {
+	principal string
+	locality  Locality
+	asn       uint
+	asnOrg    string
+	timestamp time.Time
+	held      time.Time           // Time the candidate was held
+	alert     *alertDetailsBranch // Alert to send if not part of a shift, or nil
+}
+
+func (c *stormCandidate) key() string {
+	return fmt.Sprintf("%v|%v|%v|%v", c.locality.City, c.locality.Subdivision,
+		c.locality.Country, c.asn)
+}
+
+// Tracks new geocenters across principals to identify location shifts, where
+// many principals are seen in the same new locality and network within the
+// window (e.g., an office changing ISP, or an address block being reassigned)
+type stormIndex struct {
+	sync.Mutex
+	pending []stormCandidate
+	seen    map[string]map[string]time.Time // Locality key -> principal -> time held
+	shifts  map[string]time.Time            // Locality key -> time last seen in shift
+}
+
+var storms stormIndex
+
+func (s *stormIndex) reset() {
+	s.Lock()
+	s.pending = nil
+	s.seen = nil
+	s.shifts = nil
+	s.Unlock()
+}
+
+// Returns true if location shift detection is enabled
+func stormEnabled() bool {
+	return cfg.Geo.StormThreshold != 0
+}
+
+// Returns true if a new geocenter for res can be correlated with other
+// principals; both the city and the network must be known, otherwise
+// unrelated principals in the same country or network would be grouped
+func stormEligible(res objectResult) bool {
+	return !res.Ungeolocated && res.Locality.City != "" && res.ASN != 0
+}
+
+func (s *stormIndex) hold(c stormCandidate) {
+	if c.held.IsZero() {
+		c.held = time.Now().UTC()
+	}
+	s.Lock()
+	s.pending = append(s.pending, c)
+	s.Unlock()
+}
+
+// Correlate the held new geocenters with those seen within the window.
+// Returns the location shifts identified, and the held alerts that are not
+// part of a location shift and have been held for the grace period, which
+// should be sent individually.
+func (s *stormIndex) flush(now time.Time) (shifts []alertDetailsLocationShift, release []alertDetailsBranch, err error) {
+	window := cfg.Geo.StormWindow
+	if window == "" {
+		window = defaultStormWindow
+	}
+	dur, err := time.ParseDuration(window)
+	if err != nil {
+		return nil, nil, err
+	}
+	grace := cfg.Geo.StormGrace
+	if grace == "" {
+		grace = defaultStormGrace
+	}
+	gdur, err := time.ParseDuration(grace)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	if s.seen == nil {
+		s.seen = make(map[string]map[string]time.Time)
+		s.shifts = make(map[string]time.Time)
+	}
+
+	// Remove principals and shifts that are no longer within the window
+	cutoff := now.Add(-1 * dur)
+	for k, p := range s.seen {
+		for x, t := range p {
+			if t.Before(cutoff) {
+				delete(p, x)
+			}
+		}
+		if len(p) == 0 {
+			delete(s.seen, k)
+		}
+	}
+	for k, v := range s.shifts {
+		if v.Before(cutoff) {
+			delete(s.shifts, k)
+		}
+	}
+
+	bykey := make(map[string][]stormCandidate)
+	var keys []string
+	for _, c := range s.pending {
+		k := c.key()
+		if _, ok := bykey[k]; !ok {
+			keys = append(keys, k)
+		}
+		bykey[k] = append(bykey[k], c)
+		p, ok := s.seen[k]
+		if !ok {
+			p = make(map[string]time.Time)
+			s.seen[k] = p
+		}
+		if _, ok := p[c.principal]; !ok {
+			p[c.principal] = c.held
+		}
+	}
+	s.pending = nil
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		cl := bykey[k]
+		if _, active := s.shifts[k]; active {
+			s.shifts[k] = now
+			lval, err := cl[0].locality.assemble()
+			if err != nil {
+				return nil, nil, err
+			}
+			logf("[NOTICE] %v new geocenters (%v) suppressed as part of location shift",
+				len(cl), lval)
+			continue
+		}
+		if len(s.seen[k]) < cfg.Geo.StormThreshold {
+			for _, c := range cl {
+				if now.Sub(c.held) < gdur {
+					s.pending = append(s.pending, c)
+					continue
+				}
+				if c.alert != nil {
+					release = append(release, *c.alert)
+				}
+			}
+			continue
+		}
+		s.shifts[k] = now
+		ad := alertDetailsLocationShift{
+			Locality: cl[0].locality,
+			ASN:      cl[0].asn,
+			ASNOrg:   cl[0].asnOrg,
+			Window:   window,
+			Severity: 1,
+		}
+		for p := range s.seen[k] {
+			ad.Principals = append(ad.Principals, p)
+		}
+		sort.Strings(ad.Principals)
+		// Use the highest severity of the alerts being replaced, so policy
+		// adjustments for the locality still apply
+		for _, c := range cl {
+			if c.timestamp.After(ad.Timestamp) {
+				ad.Timestamp = c.timestamp
+			}
+			if c.alert != nil && c.alert.Severity > ad.Severity {
+				ad.Severity = c.alert.Severity
+			}
+		}
+		shifts = append(shifts, ad)
+	}
+	return shifts, release, nil
+}
+
+// Remove all held candidates regardless of the grace period, returning the
+// alerts they were holding
+func (s *stormIndex) takePending() (ret []alertDetailsBranch) {
+	s.Lock()
+	defer s.Unlock()
+	for _, c := range s.pending {
+		if c.alert != nil {
+			ret = append(ret, *c.alert)
+		}
+	}
+	s.pending = nil
+	return ret
+}
+
+// Send any held alerts individually; the geocenters have already been
+// escalated in the stored state, so the alerts would otherwise be lost if
+// the merge process stops within the grace period
+func releaseStorms() error {
+	release := storms.takePending()
+	if len(release) != 0 {
+		logf("releasing %v held alerts", len(release))
+	}
+	for i := range release {
+		err := sendAlert(&release[i])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Correlate the held new geocenters, sending a single alert for each location
+// shift and individual alerts for the others once the grace period has passed
+func analyzeStorms() error {
+	if !stormEnabled() {
+		return nil
+	}
+	shifts, release, err := storms.flush(time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	for _, x := range shifts {
+		lval, err := x.Locality.assemble()
+		if err != nil {
+			return err
+		}
+		logf("[NOTICE] location shift to %v for %v principals", lval,
+			len(x.Principals))
+		if cfg.noSendAlert {
+			continue
+		}
+		err = sendAlert(&x)
+		if err != nil {
+			return err
+		}
+	}
+	for i := range release {
+		err = sendAlert(&release[i])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Describes an alert for many principals seen in the same new locality
+type alertDetailsLocationShift struct {
+	Locality   Locality  `json:"locality_details"`
+	ASN        uint      `json:"asn,omitempty"`
+	ASNOrg     string    `json:"asn_org,omitempty"`
+	Principals []string  `json:"principals"`
+	Window     string    `json:"window"`
+	Timestamp  time.Time `json:"event_time"`
+	Severity   int       `json:"severity"`
+}
+
+func (ad *alertDetailsLocationShift) makeSummary() (string, error) {
+	lval, err := ad.Locality.assemble()
+	if err != nil {
+		return "", err
+	}
+	ret := fmt.Sprintf("LOCATIONSHIFT %v new location for %v principals", lval,
+		len(ad.Principals))
+	if ad.ASN != 0 {
+		ret += fmt.Sprintf(" [AS%v %v]", ad.ASN, ad.ASNOrg)
+	}
+	plist := ad.Principals
+	more := ""
+	if len(plist) > 10 {
+		more = fmt.Sprintf(" and %v more", len(plist)-10)
+		plist = plist[:10]
+	}
+	ret += fmt.Sprintf(" (%v%v)", strings.Join(plist, ", "), more)
+	return ret, nil
+}
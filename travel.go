@@ -0,0 +1,303 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor:
+// - agent agent@local
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Handling of alerts that match an active travel notice
+const (
+	travelDowngrade = "downgrade" // Send the alert with informational severity
+	travelAnnotate  = "annotate"  // Send the alert at full severity, noting the travel
+)
+
+// A notice that a principal is expected to travel to certain destinations
+// within a date range
+type travelNotice struct {
+	ID           int       `json:"id"`
+	Principal    string    `json:"principal"`
+	Destinations []string  `json:"destinations"` // Country codes, or city/country code
+	Start        time.Time `json:"start"`
+	End          time.Time `json:"end"`
+
+	fromFile bool // Loaded from the travel notices file
+}
+
+// Travel notices in use, from the travel notices file and the travel API
+type travelStore struct {
+	sync.RWMutex
+	notices []travelNotice
+	nextID  int
+}
+
+var travelNotices travelStore
+
+func (tn *travelNotice) validate() error {
+	if tn.Principal == "" {
+		return fmt.Errorf("travel notice must have a principal")
+	}
+	if len(tn.Destinations) == 0 {
+		return fmt.Errorf("travel notice for %v must have a destination", tn.Principal)
+	}
+	for i := range tn.Destinations {
+		tn.Destinations[i] = strings.TrimSpace(tn.Destinations[i])
+		_, cc := splitTravelDestination(tn.Destinations[i])
+		if len(cc) != 2 {
+			return fmt.Errorf("travel notice for %v has invalid destination %v",
+				tn.Principal, tn.Destinations[i])
+		}
+	}
+	if tn.Start.IsZero() || tn.End.IsZero() {
+		return fmt.Errorf("travel notice for %v must have a start and end", tn.Principal)
+	}
+	if !tn.End.After(tn.Start) {
+		return fmt.Errorf("travel notice for %v ends before it starts", tn.Principal)
+	}
+	return nil
+}
+
+// Split a destination into the city (empty if the destination is an entire
+// country) and the country code
+func splitTravelDestination(d string) (city string, cc string) {
+	if i := strings.LastIndex(d, "/"); i != -1 {
+		return strings.TrimSpace(d[:i]), strings.ToUpper(strings.TrimSpace(d[i+1:]))
+	}
+	return "", strings.ToUpper(d)
+}
+
+// Returns true if the notice is active at t and covers the locality
+func (tn *travelNotice) covers(l Locality, t time.Time) bool {
+	if t.Before(tn.Start) || !t.Before(tn.End) {
+		return false
+	}
+	for _, x := range tn.Destinations {
+		city, cc := splitTravelDestination(x)
+		if !strings.EqualFold(l.CountryCode, cc) {
+			continue
+		}
+		if city == "" || strings.EqualFold(l.City, city) {
+			return true
+		}
+	}
+	return false
+}
+
+// Parse a start or end value from the travel notices file, which can either
+// be a date or an RFC3339 timestamp. An end date includes the entire day.
+func parseTravelTime(s string, end bool) (time.Time, error) {
+	t, err := time.Parse("2006-01-02", s)
+	if err == nil {
+		if end {
+			t = t.Add(24 * time.Hour)
+		}
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// Create a travel notice from a single record in the travel notices file
+func parseTravelNotice(record []string) (ret travelNotice, err error) {
+	if len(record) < 4 {
+		return ret, fmt.Errorf("travel notice must have at least 4 elements: %v", record)
+	}
+	for i := range record {
+		record[i] = strings.TrimSpace(record[i])
+	}
+	ret.Principal = record[0]
+	ret.Start, err = parseTravelTime(record[1], false)
+	if err != nil {
+		return ret, err
+	}
+	ret.End, err = parseTravelTime(record[2], true)
+	if err != nil {
+		return ret, err
+	}
+	ret.Destinations = record[3:]
+	ret.fromFile = true
+	err = ret.validate()
+	return ret, err
+}
+
+func readTravelNotices(path string) (ret []travelNotice, err error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	reader := csv.NewReader(fd)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		tn, err := parseTravelNotice(record)
+		if err != nil {
+			line, _ := reader.FieldPos(0)
+			return nil, fmt.Errorf("%v line %v: %v", path, line, err)
+		}
+		ret = append(ret, tn)
+	}
+	return ret, nil
+}
+
+// Replace the notices loaded from the travel notices file, notices added
+// using the travel API are kept
+func (s *travelStore) load(notices []travelNotice) {
+	s.Lock()
+	defer s.Unlock()
+	var nl []travelNotice
+	for _, x := range s.notices {
+		if !x.fromFile {
+			nl = append(nl, x)
+		}
+	}
+	for _, x := range notices {
+		s.nextID++
+		x.ID = s.nextID
+		nl = append(nl, x)
+	}
+	s.notices = nl
+}
+
+func (s *travelStore) add(tn travelNotice) travelNotice {
+	s.Lock()
+	defer s.Unlock()
+	s.nextID++
+	tn.ID = s.nextID
+	s.notices = append(s.notices, tn)
+	return tn
+}
+
+// Remove the notice with the specified ID, returns false if it does not exist
+func (s *travelStore) remove(id int) bool {
+	s.Lock()
+	defer s.Unlock()
+	for i := range s.notices {
+		if s.notices[i].ID == id {
+			s.notices = append(s.notices[:i], s.notices[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Return the notices for principal, or all notices if principal is empty
+func (s *travelStore) list(principal string) []travelNotice {
+	s.RLock()
+	defer s.RUnlock()
+	ret := make([]travelNotice, 0)
+	for _, x := range s.notices {
+		if principal == "" || x.Principal == principal {
+			ret = append(ret, x)
+		}
+	}
+	return ret
+}
+
+// Return the notice for principal that covers the locality at t, or nil if
+// there is none
+func (s *travelStore) find(principal string, l Locality, t time.Time) *travelNotice {
+	s.RLock()
+	defer s.RUnlock()
+	for i := range s.notices {
+		if s.notices[i].Principal != principal {
+			continue
+		}
+		if s.notices[i].covers(l, t) {
+			ret := s.notices[i]
+			return &ret
+		}
+	}
+	return nil
+}
+
+func (s *travelStore) reset() {
+	s.Lock()
+	s.notices = nil
+	s.nextID = 0
+	s.Unlock()
+}
+
+// Read the travel notices file again; if the file cannot be read the
+// existing notices are kept
+func reloadTravelNotices() error {
+	if cfg.General.TravelNotices == "" {
+		return nil
+	}
+	notices, err := readTravelNotices(cfg.General.TravelNotices)
+	if err != nil {
+		return err
+	}
+	travelNotices.load(notices)
+	logf("reloaded %v travel notices", len(notices))
+	return nil
+}
+
+// Returns true if alerts matching a travel notice should be downgraded
+func travelDowngraded() bool {
+	return cfg.Geo.TravelMode == "" || cfg.Geo.TravelMode == travelDowngrade
+}
+
+// Handle requests to the travel API. GET lists notices (optionally for the
+// principal parameter), POST adds a notice from a JSON document, and DELETE
+// removes the notice specified by the id parameter.
+func travelHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(travelNotices.list(r.URL.Query().Get("principal")))
+	case "POST":
+		var tn travelNotice
+		err := json.NewDecoder(r.Body).Decode(&tn)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = tn.validate()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		tn = travelNotices.add(tn)
+		logf("added travel notice %v for %v", tn.ID, tn.Principal)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(tn)
+	case "DELETE":
+		id, err := strconv.Atoi(r.URL.Query().Get("id"))
+		if err != nil {
+			http.Error(w, "invalid id", http.StatusBadRequest)
+			return
+		}
+		if !travelNotices.remove(id) {
+			http.Error(w, "travel notice not found", http.StatusNotFound)
+			return
+		}
+		logf("removed travel notice %v", id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}